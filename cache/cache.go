@@ -1,107 +1,713 @@
 package cache
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"net/http"
-	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
 )
 
 type Cache interface {
 	Get(key interface{}) (interface{}, bool)
 	Set(key, value interface{}, cost int64) bool
+	Del(key interface{})
+}
+
+// Clearer is a Cache that can remove all its entries at once, Purge uses it instead of deleting
+// the keys known by the wrapper one by one
+type Clearer interface {
+	Clear()
+}
+
+// Waiter is a Cache that applies Set asynchronously, e.g. ristretto, Wait blocks until the buffered
+// writes are applied. The wrapper waits after each write so an Add is visible to the next GetManifests
+type Waiter interface {
+	Wait()
 }
 
 type HttpClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// Entry is the value stored on cache for each key, it holds the revision of the repository
+// and the manifests rendered while the repository had that revision
+type Entry struct {
+	Revision  string                      `json:"revision"`
+	Manifests []unstructured.Unstructured `json:"manifests,omitempty"`
+	// Encoded are the manifests encoded by the codec of the wrapper, it is set instead of Manifests
+	// when the wrapper has a codec
+	Encoded []byte `json:"encoded,omitempty"`
+	// Paths are the paths of the repository the manifests were rendered from, when the wrapper scopes
+	// revisions to paths. Scoped reports the Revision is the one of the Paths, manifests rendered before
+	// their paths were known keep the revision of the repository until it is checked again
+	Paths  []string `json:"paths,omitempty"`
+	Scoped bool     `json:"scoped,omitempty"`
+	// Files are the files the manifests were rendered from, relative to the subdirectory of the key,
+	// and Digest is the hash of their content
+	Files  []string `json:"files,omitempty"`
+	Digest string   `json:"digest,omitempty"`
+	// Remotes are the revisions of the remote bases and resources the manifests were rendered from by their
+	// source, the manifests are outdated when any of them changes
+	Remotes map[string]string `json:"remotes,omitempty"`
+	// Outdated reports the revision changed since the manifests were rendered, they are only kept to be reused
+	// when the files they were rendered from are unchanged
+	Outdated bool `json:"outdated,omitempty"`
+	// Validated is when the revision was last checked, it is only tracked when the wrapper has a freshness window
+	Validated time.Time `json:"validated,omitempty"`
+	// Size is the size in bytes of the Manifests serialized as json, computed once when they are stored
+	// so the cost of the entry is known without serializing them again
+	Size int64 `json:"size,omitempty"`
+}
+
+// Inputs describes what the manifests of a key were rendered from, relative to the subdirectory of the key
+type Inputs struct {
+	// Paths are the directories the manifests were rendered from
+	Paths []string
+	// Files are the files the manifests were rendered from and Digest is the hash of their content,
+	// Files are ignored when Digest is empty
+	Files  []string
+	Digest string
+	// Remotes are the revisions of the remote bases and resources the manifests were rendered from by their
+	// source, fetched with RemoteRevision before each remote was cloned. An empty revision is unknown
+	Remotes map[string]string
+}
+
+// Result is the outcome of a cache lookup
+type Result struct {
+	Manifests []unstructured.Unstructured
+	// Stale reports the manifests were returned without being validated, because the revision check failed
+	// or because they are being revalidated on background
+	Stale bool
+	// Err is the error of the revision check of stale manifests
+	Err error
+}
+
+// CostFunc returns the cost of an entry on cache, e.g. its size in bytes, so the max cost of the cache bounds memory
+type CostFunc func(entry Entry) int64
+
+// EntryCost is the default CostFunc, the size in bytes of the revision and of the manifests serialized as json.
+// The manifests are only serialized when the entry doesn't have their Size
+func EntryCost(entry Entry) int64 {
+	cost := int64(len(entry.Revision))
+	switch {
+	case entry.Size > 0:
+		cost += entry.Size
+	case entry.Manifests != nil:
+		// manifests are plain data decoded from json, marshalling them never fails
+		manifests, _ := json.Marshal(entry.Manifests)
+		cost += int64(len(manifests))
+	}
+	cost += int64(len(entry.Encoded))
+	if cost < 1 {
+		return 1
+	}
+	return cost
+}
+
 type Wrapper struct {
-	cache      Cache
-	httpClient HttpClient
-}
-
-//GetManifests checks using the etag of resource if the resource is modified on github using conditional requests
-//( https://docs.github.com/en/rest/overview/resources-in-the-rest-api#conditional-requests)
-// if is not modified return manifests stored on cache
-func (w Wrapper) GetManifests(source string) ([]unstructured.Unstructured, error) {
-	var unstructuredManifests []unstructured.Unstructured
-	var etag string
-	repo, owner := w.getRepoOwner(source)
-	apiUrl := fmt.Sprintf("https://api.github.com/repos/%s/%s", owner, repo)
-	etagItem, got := w.cache.Get(source)
+	cache           Cache
+	providers       map[string]RevisionProvider
+	defaultProvider RevisionProvider
+	tokenSource     oauth2.TokenSource
+	githubBaseURL   string
+	githubHosts     map[string]string
+	staleIfError    bool
+	maxAge          time.Duration
+	revalidateAge   time.Duration
+	revalidateTime  time.Duration
+	revalidating    *sync.Map
+	cost            CostFunc
+	codec           Codec
+	keys            *keyIndex
+	pathScoped      bool
+	metrics         *Metrics
+}
+
+// Option configures a Wrapper
+type Option func(*Wrapper)
+
+// WithRevisionProvider registers the provider used to detect changes of the sources hosted on host
+func WithRevisionProvider(host string, provider RevisionProvider) Option {
+	return func(w *Wrapper) {
+		w.providers[host] = provider
+	}
+}
+
+// WithTokenSource authenticates the requests to the GitHub API with the tokens of tokenSource,
+// raising the rate limit and giving access to private repositories
+func WithTokenSource(tokenSource oauth2.TokenSource) Option {
+	return func(w *Wrapper) {
+		w.tokenSource = tokenSource
+	}
+}
+
+// WithGitHubBaseURL sets the url of the GitHub API used for github.com sources,
+// e.g. an httptest server on tests
+func WithGitHubBaseURL(baseURL string) Option {
+	return func(w *Wrapper) {
+		w.githubBaseURL = baseURL
+	}
+}
+
+// WithGitHubEnterprise checks the sources hosted on host with the GitHub API at baseURL,
+// e.g. WithGitHubEnterprise("github.example.com", "https://github.example.com/api/v3")
+func WithGitHubEnterprise(host, baseURL string) Option {
+	return func(w *Wrapper) {
+		w.githubHosts[host] = baseURL
+	}
+}
+
+// WithStaleIfError returns the manifests on cache marked as stale when the revision check fails,
+// so renders keep working while the source host is unreachable
+func WithStaleIfError() Option {
+	return func(w *Wrapper) {
+		w.staleIfError = true
+	}
+}
+
+// WithMaxAge serves the manifests of entries validated within maxAge straight from cache,
+// without checking the revision of the source
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(w *Wrapper) {
+		w.maxAge = maxAge
+	}
+}
+
+// WithStaleWhileRevalidate serves the manifests of entries older than the max age by up to window as stale,
+// while their revision is checked on background
+func WithStaleWhileRevalidate(window time.Duration) Option {
+	return func(w *Wrapper) {
+		w.revalidateAge = window
+	}
+}
+
+// WithRevalidateTimeout bounds the background revision checks of WithStaleWhileRevalidate, by default
+// they are given up after the stale while revalidate window, so a hung request doesn't keep the key
+// from being revalidated again
+func WithRevalidateTimeout(timeout time.Duration) Option {
+	return func(w *Wrapper) {
+		w.revalidateTime = timeout
+	}
+}
+
+// WithCostFunc sets the function computing the cost of the entries stored on cache, by default EntryCost.
+// A TieredCache should be built WithFillCost of the same function
+func WithCostFunc(cost CostFunc) Option {
+	return func(w *Wrapper) {
+		w.cost = cost
+	}
+}
+
+// WithCodec stores the manifests on cache encoded with codec, e.g. GzipCodec{} to save memory on large renders
+func WithCodec(codec Codec) Option {
+	return func(w *Wrapper) {
+		w.codec = codec
+	}
+}
+
+// WithMetrics records the metrics of the wrapper on metrics instead of its own, e.g. to share them with
+// the eviction callbacks of the cache
+func WithMetrics(metrics *Metrics) Option {
+	return func(w *Wrapper) {
+		w.metrics = metrics
+	}
+}
+
+// WithPathScopedRevisions scopes the revision of the manifests to the paths of the repository they were rendered
+// from, when the provider of the source host is a PathRevisionProvider. Changes to other paths, like other
+// overlays or the README, don't invalidate them
+func WithPathScopedRevisions() Option {
+	return func(w *Wrapper) {
+		w.pathScoped = true
+	}
+}
+
+// PathScoped reports if the wrapper was built WithPathScopedRevisions, renderers should then add the manifests
+// with AddWithPaths
+func (w Wrapper) PathScoped() bool {
+	return w.pathScoped
+}
+
+// WithDefaultRevisionProvider sets the provider used for sources of hosts without a registered provider,
+// e.g. NewGitProvider() to detect changes of any git remote
+func WithDefaultRevisionProvider(provider RevisionProvider) Option {
+	return func(w *Wrapper) {
+		w.defaultProvider = provider
+	}
+}
+
+//GetManifests checks using the revision provider of the source host if the resource is modified,
+// if is not modified return manifests stored on cache for the key.
+// A miss is reported with ErrNotCached or ErrModified, failures fetching the revision with ErrUpstream,
+// refused credentials also with ErrUnauthorized, and sources whose revision can't be known, like sources of hosts without a provider, with ErrUncacheable
+func (w Wrapper) GetManifests(key Key) ([]unstructured.Unstructured, error) {
+	return w.GetManifestsContext(context.Background(), key)
+}
+
+// GetManifestsContext is like GetManifests but the revision request is canceled when the context is done
+func (w Wrapper) GetManifestsContext(ctx context.Context, key Key) ([]unstructured.Unstructured, error) {
+	result, err := w.Lookup(ctx, key)
+	return result.Manifests, err
+}
+
+// Lookup is like GetManifestsContext but reports if the manifests are stale.
+// While the provider is rate limited, or when the revision check fails and the wrapper was built
+// WithStaleIfError, the manifests on cache are returned as stale. When there are none
+// the error of the revision check is returned.
+// Entries validated within the max age are returned without checking the revision
+func (w Wrapper) Lookup(ctx context.Context, key Key) (Result, error) {
+	result, err := w.lookup(ctx, key, true)
+	w.metrics.lookedUp(err)
+	return result, err
+}
+
+// Validate is like Lookup but doesn't copy or decode the manifests on cache, it only reports if they can be
+// served, stale ones included, so callers keeping the cache warm don't pay for manifests they discard
+func (w Wrapper) Validate(ctx context.Context, key Key) error {
+	_, err := w.lookup(ctx, key, false)
+	w.metrics.lookedUp(err)
+	return err
+}
+
+// lookup checks the manifests of the key on cache, decode tells if the result carries a copy of them
+func (w Wrapper) lookup(ctx context.Context, key Key, decode bool) (Result, error) {
+	provider, err := w.revisionProvider(key)
+	if err != nil {
+		return Result{}, err
+	}
+	generation := w.keys.add(key)
+	item, got := w.cache.Get(key.String())
 	if !got {
-		response, err := w.doRequest(apiUrl, map[string]string{})
+		revision, _, err := w.revision(ctx, provider, key, Entry{})
+		if errors.Is(err, ErrRateLimited) {
+			// an entry without revision lets the manifests be added and is checked once the limit resets
+			w.setCurrent(key, Entry{}, generation)
+			return Result{}, err
+		}
 		if err != nil {
-			return nil, err
+			return Result{}, err
 		}
-		etag = response.Header.Get("ETag")
-		set := w.cache.Set(source, etag, 1)
+		set := w.setCurrent(key, Entry{Revision: revision, Validated: w.validatedAt()}, generation)
 		if !set {
-			return nil, err
+			return Result{}, fmt.Errorf("%w: failed to set revision to cache", ErrUncacheable)
 		}
-		return nil, errors.New("first request, not cached yet")
+		return Result{}, ErrNotCached
 	}
-	etag = etagItem.(string)
-	headers := map[string]string{
-		"If-None-Match": etag,
+	entry := item.(Entry)
+	if entry.hasManifests() && w.tracksValidation() {
+		age := time.Since(entry.Validated)
+		if age < w.maxAge {
+			return w.found(entry, false, nil, decode)
+		}
+		if age < w.maxAge+w.revalidateAge {
+			w.revalidate(provider, key, entry, generation)
+			return w.found(entry, true, nil, decode)
+		}
+	}
+	return w.validate(ctx, provider, key, entry, generation, decode)
+}
+
+// validate checks the revision of the entry read from cache at generation, storing the new revision when the
+// source changed
+func (w Wrapper) validate(ctx context.Context, provider RevisionProvider, key Key, entry Entry, generation uint64, decode bool) (Result, error) {
+	revision, modified, err := w.revision(ctx, provider, key, entry)
+	if err == nil && !modified && entry.hasManifests() {
+		modified = w.remotesModified(ctx, entry.Remotes)
+	}
+	if err != nil && entry.hasManifests() && w.serveStale(ctx, err) {
+		return w.found(entry, true, err, decode)
 	}
-	response, err := w.doRequest(apiUrl, headers)
 	if err != nil {
-		return unstructuredManifests, err
+		return Result{}, err
 	}
-	if response.StatusCode == http.StatusNotModified {
-		item, got := w.cache.Get(etag)
-		if !got {
-			return nil, fmt.Errorf("failed to get value from key %s", item)
+	if !modified {
+		w.metrics.notModifiedFound()
+		if !entry.hasManifests() {
+			return Result{}, fmt.Errorf("%w for key %s", ErrNotCached, key)
 		}
-		unstructuredManifests = item.([]unstructured.Unstructured)
-		if err != nil {
-			return nil, err
+		if revision != entry.Revision || w.tracksValidation() {
+			// the revision of the repository is replaced by the one of the paths it was rendered from
+			entry.Revision, entry.Scoped = revision, len(entry.Paths) > 0
+			entry.Validated = w.validatedAt()
+			w.setCurrent(key, entry, generation)
+		}
+		return w.found(entry, false, nil, decode)
+	}
+	set := w.setCurrent(key, entry.outdated(revision, w.validatedAt()), generation)
+	if !set {
+		return Result{}, fmt.Errorf("%w: failed to set revision to cache", ErrUncacheable)
+	}
+	return Result{}, ErrModified
+}
+
+// remotesModified reports if the revision of any of the remote sources changed. Remotes whose revision is
+// unknown or can't be fetched are reported as modified, so their manifests are rendered again
+func (w Wrapper) remotesModified(ctx context.Context, remotes map[string]string) bool {
+	for source, revision := range remotes {
+		if revision == "" {
+			return true
+		}
+		current, err := w.remoteRevision(ctx, source, revision)
+		if err != nil || current != revision {
+			return true
 		}
-		return unstructuredManifests, nil
 	}
-	return nil, errors.New("resource modified, should download it again")
+	return false
+}
+
+// RemoteRevision fetches the current revision of a remote base or resource, given by its go-getter source.
+// Renderers fetch it before the remote is cloned and add it with AddInputs
+func (w Wrapper) RemoteRevision(ctx context.Context, source string) (string, error) {
+	return w.remoteRevision(ctx, source, "")
+}
+
+func (w Wrapper) remoteRevision(ctx context.Context, source, validator string) (string, error) {
+	key := NewKey(source, "", "")
+	provider, err := w.revisionProvider(key)
+	if err != nil {
+		return "", err
+	}
+	revision, err := provider.Revision(ctx, key, validator)
+	w.metrics.revisionChecked(err)
+	return revision, err
+}
+
+// outdated returns the entry of the new revision of the source, keeping the manifests of the entry
+// when the files they were rendered from are known, so they can be reused
+func (e Entry) outdated(revision string, validated time.Time) Entry {
+	scoped := len(e.Paths) > 0
+	if e.Digest == "" || !e.hasManifests() {
+		return Entry{Revision: revision, Paths: e.Paths, Scoped: scoped, Validated: validated}
+	}
+	return Entry{
+		Revision:  revision,
+		Manifests: e.Manifests,
+		Encoded:   e.Encoded,
+		Size:      e.Size,
+		Paths:     e.Paths,
+		Scoped:    scoped,
+		Files:     e.Files,
+		Digest:    e.Digest,
+		Outdated:  true,
+		Validated: validated,
+	}
 }
 
-func (w Wrapper) doRequest(url string, headers map[string]string) (*http.Response, error) {
-	request, err := http.NewRequest("GET", url, nil)
+// revision fetches the current revision of the entry, scoped to its paths when it has them, and reports if it changed
+func (w Wrapper) revision(ctx context.Context, provider RevisionProvider, key Key, entry Entry) (string, bool, error) {
+	revision, modified, err := fetchRevision(ctx, provider, key, entry)
+	w.metrics.revisionChecked(err)
+	if err == nil {
+		w.metrics.validated(key.Source)
+	}
+	return revision, modified, err
+}
 
-	for key, value := range headers {
-		request.Header.Add(key, value)
+func fetchRevision(ctx context.Context, provider RevisionProvider, key Key, entry Entry) (string, bool, error) {
+	scoped, ok := provider.(PathRevisionProvider)
+	if !ok || len(entry.Paths) == 0 {
+		revision, err := provider.Revision(ctx, key, entry.Revision)
+		return revision, revision != entry.Revision, err
+	}
+	revision, err := scoped.PathRevision(ctx, key, entry.Paths)
+	if err != nil || entry.Scoped {
+		return revision, revision != entry.Revision, err
 	}
+	// the entry still has the revision of the repository it was rendered at. The revision of the paths
+	// replaces it when the repository is unchanged, checked after the paths so no change lands in between
+	repository, err := provider.Revision(ctx, key, entry.Revision)
 	if err != nil {
-		return nil, err
+		return "", false, err
+	}
+	return revision, repository != entry.Revision, nil
+}
+
+// revalidate checks the revision of the entry on background, only one check runs at a time for each key
+// and it is given up after the revalidate timeout
+func (w Wrapper) revalidate(provider RevisionProvider, key Key, entry Entry, generation uint64) {
+	if _, running := w.revalidating.LoadOrStore(key.String(), struct{}{}); running {
+		return
 	}
-	response, err := w.httpClient.Do(request)
+	timeout := w.revalidateTime
+	if timeout <= 0 {
+		timeout = w.revalidateAge
+	}
+	go func() {
+		defer w.revalidating.Delete(key.String())
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, _ = w.validate(ctx, provider, key, entry, generation, false)
+	}()
+}
+
+func (w Wrapper) tracksValidation() bool {
+	return w.maxAge > 0 || w.revalidateAge > 0
+}
+
+// validatedAt returns the validation time stored on new entries, zero when it is not tracked
+func (w Wrapper) validatedAt() time.Time {
+	if !w.tracksValidation() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (w Wrapper) set(key Key, entry Entry) bool {
+	if !w.put(key, entry) {
+		return false
+	}
+	w.wait()
+	return true
+}
+
+// setCurrent is like set for the entries written back by a lookup started at generation, the entry is dropped
+// when the key was invalidated since, so an invalidation isn't undone by the lookups in flight. A dropped entry
+// is reported as set, as there is nothing left to store
+func (w Wrapper) setCurrent(key Key, entry Entry, generation uint64) bool {
+	set := true
+	w.keys.ifCurrent(key.String(), generation, func() {
+		set = w.put(key, entry)
+	})
+	if set {
+		w.wait()
+	}
+	return set
+}
+
+// put sets the entry on cache without waiting for the write to be applied
+func (w Wrapper) put(key Key, entry Entry) bool {
+	cost := w.cost(entry)
+	// the cost is recorded before the set, the cache may evict or reject the entry before Set returns
+	previous, existed := w.metrics.stored(key.String(), cost)
+	set := w.cache.Set(key.String(), entry, cost)
+	if !set {
+		w.metrics.unstored(key.String(), cost, previous, existed)
+	}
+	return set
+}
+
+// ID identifies the wrapper, the copies of a Wrapper share it as they share the cache and the keys looked up
+func (w Wrapper) ID() string {
+	return fmt.Sprintf("%p", w.keys)
+}
+
+// Stats returns a snapshot of the metrics of the wrapper
+func (w Wrapper) Stats() Stats {
+	return w.metrics.Stats()
+}
+
+// serveStale reports if the manifests on cache should be returned after the revision check failed with err
+func (w Wrapper) serveStale(ctx context.Context, err error) bool {
+	if errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	return w.staleIfError && errors.Is(err, ErrUpstream) && ctx.Err() == nil
+}
+
+// CopyManifests deep copies manifests handed to several callers, like the ones stored on cache, so changes
+// made by a caller to the manifests it got don't leak to the others. They are copied through json as
+// manifests built by callers may hold values unstructured.DeepCopy panics on, like int
+func CopyManifests(manifests []unstructured.Unstructured) ([]unstructured.Unstructured, error) {
+	copies, _, err := copyManifestsSize(manifests)
+	return copies, err
+}
+
+// copyManifestsSize is like CopyManifests but also returns the size of the manifests serialized as json
+func copyManifestsSize(manifests []unstructured.Unstructured) ([]unstructured.Unstructured, int64, error) {
+	if manifests == nil {
+		return nil, 0, nil
+	}
+	data, err := json.Marshal(manifests)
 	if err != nil {
-		return nil, err
+		return nil, 0, fmt.Errorf("error copying manifests: %w", err)
+	}
+	var copies []unstructured.Unstructured
+	if err := json.Unmarshal(data, &copies); err != nil {
+		return nil, 0, fmt.Errorf("error copying manifests: %w", err)
+	}
+	return copies, int64(len(data)), nil
+}
+
+// found returns the result of a lookup that can serve the manifests of the entry, with a copy of them when
+// they are decoded
+func (w Wrapper) found(entry Entry, stale bool, err error, decode bool) (Result, error) {
+	if !decode {
+		return Result{Stale: stale, Err: err}, nil
 	}
-	return response, nil
+	return w.cached(entry, stale, err)
 }
 
-func (w Wrapper) getRepoOwner(source string) (string, string) {
-	arrSource := strings.Split(source, "/")
-	return arrSource[len(arrSource)-1], arrSource[len(arrSource)-2]
+// cached returns a result with a copy of the manifests of the entry, decoding them when they are encoded
+func (w Wrapper) cached(entry Entry, stale bool, err error) (Result, error) {
+	var manifests []unstructured.Unstructured
+	var copyErr error
+	switch {
+	case entry.Encoded == nil:
+		manifests, copyErr = CopyManifests(entry.Manifests)
+	case w.codec == nil:
+		copyErr = errors.New("error decoding manifests: the wrapper has no codec")
+	default:
+		manifests, copyErr = w.codec.Decode(entry.Encoded)
+	}
+	if copyErr != nil {
+		return Result{}, copyErr
+	}
+	return Result{Manifests: manifests, Stale: stale, Err: err}, nil
+}
+
+// store sets a copy of the manifests on the entry, encoded when the wrapper has a codec
+func (w Wrapper) store(entry *Entry, manifests []unstructured.Unstructured) error {
+	if w.codec == nil {
+		copies, size, err := copyManifestsSize(manifests)
+		if err != nil {
+			return err
+		}
+		entry.Manifests, entry.Encoded, entry.Size = copies, nil, size
+		return nil
+	}
+	encoded, err := w.codec.Encode(manifests)
+	if err != nil {
+		return err
+	}
+	entry.Manifests, entry.Encoded, entry.Size = nil, encoded, 0
+	return nil
+}
+
+func (e Entry) hasManifests() bool {
+	return !e.Outdated && (e.Manifests != nil || e.Encoded != nil)
 }
 
-// Add store manifests on cache
-func (w Wrapper) Add(source string, manifests []unstructured.Unstructured) error {
-	itemETag, got := w.cache.Get(source)
+// Add store manifests on cache under the key, along with the revision fetched by GetManifests
+func (w Wrapper) Add(key Key, manifests []unstructured.Unstructured) error {
+	return w.AddWithPaths(context.Background(), key, manifests, nil)
+}
+
+// AddWithPaths is like Add but scopes the revision of the manifests to the paths they were rendered from,
+// relative to the subdirectory of the key, when the wrapper was built WithPathScopedRevisions.
+// The manifests keep the revision fetched by GetManifests before the source was downloaded, the revision
+// of the paths replaces the one of the repository on the next lookup that finds the repository unchanged
+func (w Wrapper) AddWithPaths(ctx context.Context, key Key, manifests []unstructured.Unstructured, paths []string) error {
+	return w.AddInputs(ctx, key, manifests, Inputs{Paths: paths})
+}
+
+// AddInputs is like AddWithPaths but also stores the files the manifests were rendered from and their digest,
+// so when the source revision changes the manifests can be reused with Reuse if the files are unchanged,
+// and the revisions of the remote bases and resources, so the manifests are outdated when any of them changes
+func (w Wrapper) AddInputs(ctx context.Context, key Key, manifests []unstructured.Unstructured, inputs Inputs) error {
+	item, got := w.cache.Get(key.String())
 	if !got {
-		return errors.New("error getting etag on cache")
+		return fmt.Errorf("%w: error getting revision on cache", ErrUncacheable)
+	}
+	current := item.(Entry)
+	entry := Entry{Revision: current.Revision, Validated: current.Validated}
+	if err := w.store(&entry, manifests); err != nil {
+		return err
+	}
+	if inputs.Digest != "" {
+		entry.Files, entry.Digest = inputs.Files, inputs.Digest
 	}
-	set := w.cache.Set(itemETag, manifests, 1)
+	if w.pathScoped && len(inputs.Paths) > 0 {
+		// the revision fetched before the download stays scoped while the render read the same paths
+		entry.Paths = inputs.Paths
+		entry.Scoped = current.Scoped && equalPaths(current.Paths, inputs.Paths)
+	}
+	if len(inputs.Remotes) > 0 {
+		entry.Remotes = make(map[string]string, len(inputs.Remotes))
+		for source, revision := range inputs.Remotes {
+			entry.Remotes[source] = revision
+		}
+	}
+	set := w.set(key, entry)
 	if !set {
-		return errors.New("failed to set manifests to cache")
+		return fmt.Errorf("%w: failed to set manifests to cache", ErrUncacheable)
 	}
+	w.metrics.rendered(key.Source)
 	return nil
 }
 
-func New(client Cache, httpClient HttpClient) Wrapper {
-	return Wrapper{
-		cache:      client,
-		httpClient: httpClient,
+// PreviousInputs returns the inputs of the manifests rendered before the revision of the key changed,
+// false when there are none or their files are unknown
+func (w Wrapper) PreviousInputs(key Key) (Inputs, bool) {
+	item, got := w.cache.Get(key.String())
+	if !got {
+		return Inputs{}, false
+	}
+	entry := item.(Entry)
+	if !entry.Outdated {
+		return Inputs{}, false
+	}
+	return Inputs{Paths: entry.Paths, Files: entry.Files, Digest: entry.Digest}, true
+}
+
+// Reuse stores the manifests rendered before the revision of the key changed as the manifests of the
+// current revision and returns them, when their files still have the given digest.
+// ErrNotCached is returned when there are no such manifests
+func (w Wrapper) Reuse(key Key, digest string) ([]unstructured.Unstructured, error) {
+	item, got := w.cache.Get(key.String())
+	if !got {
+		return nil, fmt.Errorf("%w for key %s", ErrNotCached, key)
+	}
+	entry := item.(Entry)
+	if !entry.Outdated || entry.Digest == "" || entry.Digest != digest {
+		return nil, fmt.Errorf("%w for key %s", ErrNotCached, key)
+	}
+	entry.Outdated = false
+	result, err := w.cached(entry, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !w.set(key, entry) {
+		return nil, errors.New("failed to set manifests to cache")
+	}
+	return result.Manifests, nil
+}
+
+// equalPaths reports if the sorted paths are the same
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// New instantiates a Wrapper that detects changes of GitHub and GitLab sources with their APIs,
+// sources of other hosts are reported with ErrUncacheable unless a provider is registered to its host
+// or a default provider is set
+func New(client Cache, httpClient HttpClient, options ...Option) Wrapper {
+	w := Wrapper{
+		cache:         client,
+		providers:     map[string]RevisionProvider{},
+		githubBaseURL: githubAPIURL,
+		githubHosts:   map[string]string{},
+		revalidating:  &sync.Map{},
+		cost:          EntryCost,
+		keys:          newKeyIndex(),
+		metrics:       NewMetrics(),
+	}
+	for _, option := range options {
+		option(&w)
+	}
+	for host, baseURL := range w.githubHosts {
+		if _, ok := w.providers[host]; !ok {
+			w.providers[host] = NewGitHubProvider(httpClient, baseURL, w.tokenSource)
+		}
+	}
+	if _, ok := w.providers[githubHost]; !ok {
+		w.providers[githubHost] = NewGitHubProvider(httpClient, w.githubBaseURL, w.tokenSource)
+	}
+	if _, ok := w.providers[gitlabHost]; !ok {
+		w.providers[gitlabHost] = NewGitLabProvider(httpClient, gitlabAPIURL)
 	}
+	return w
 }
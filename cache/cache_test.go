@@ -1,25 +1,35 @@
 package cache_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/dgraph-io/ristretto"
 	. "github.com/onsi/ginkgo"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/thallesfreitaszup/lib-kustomize/cache"
 	"github.com/thallesfreitaszup/lib-kustomize/cache/mocks"
+	"golang.org/x/oauth2"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var _ = Describe("Cache", func() {
 	var etag string
 	var source string
+	var key cache.Key
 	var mockCache *mocks.Cache
 	var httpClient *mocks.HttpClient
 	BeforeEach(func() {
 
 		etag = "etag-example"
-		source = "example.com/source"
+		source = "github.com/org/source"
+		key = cache.NewKey(source, "overlays/dev", "")
 		mockCache = new(mocks.Cache)
 		httpClient = new(mocks.HttpClient)
 	})
@@ -27,12 +37,12 @@ var _ = Describe("Cache", func() {
 
 		It("should do the request and save the etag on cache", func() {
 
-			mockCache.On("Get", source).Return(nil, false)
-			httpClient.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(etag), nil)
-			mockCache.On("Set", source, etag, int64(1)).Times(1).Return(true)
+			mockCache.On("Get", key.String()).Return(nil, false)
+			httpClient.On("Do", mock.Anything).Return(getHTTPResponse(etag), nil)
+			mockCache.On("Set", key.String(), cache.Entry{Revision: etag}, cache.EntryCost(cache.Entry{Revision: etag})).Times(1).Return(true)
 			manifestCache := cache.New(mockCache, httpClient)
-			manifests, err := manifestCache.GetManifests(source)
-			assert.Equal(GinkgoT(), err, errors.New("first request, not cached yet"))
+			manifests, err := manifestCache.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
 			assert.Equal(GinkgoT(), len(manifests), 0)
 		})
 	})
@@ -40,51 +50,595 @@ var _ = Describe("Cache", func() {
 	Context("When is the second request for a repository and the content of repository did not change", func() {
 		It("should return the cached manifests", func() {
 
-			mockCache.On("Get", source).Return(etag, true)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
 			httpClient.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(etag), nil)
-			mockCache.On("Set", source, etag, int64(1)).Times(1).Return(true)
-			mockCache.On("Get", etag).Return(getManifestsCached(), true)
 			manifestCache := cache.New(mockCache, httpClient)
-			manifests, err := manifestCache.GetManifests(source)
+			manifests, err := manifestCache.GetManifests(key)
 			assert.Equal(GinkgoT(), err, nil)
 			assert.Equal(GinkgoT(), len(manifests), 1)
 		})
 	})
 
+	Context("When the manifests on cache are only validated", func() {
+		It("should check the revision without decoding them", func() {
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Encoded: []byte("not decodable")}, true)
+			httpClient.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(etag), nil)
+			manifestCache := cache.New(mockCache, httpClient)
+			assert.NoError(GinkgoT(), manifestCache.Validate(context.Background(), key))
+			_, err := manifestCache.Lookup(context.Background(), key)
+			assert.EqualError(GinkgoT(), err, "error decoding manifests: the wrapper has no codec")
+		})
+
+		It("should report the miss when the repository changed", func() {
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			httpClient.On("Do", mock.Anything).Return(getHTTPResponse("new-etag"), nil)
+			mockCache.On("Set", key.String(), cache.Entry{Revision: "new-etag"}, mock.Anything).Return(true)
+			manifestCache := cache.New(mockCache, httpClient)
+			assert.ErrorIs(GinkgoT(), manifestCache.Validate(context.Background(), key), cache.ErrModified)
+		})
+	})
+
 	Context("When is a invalid request ", func() {
 		It("should return error", func() {
 			errorRequest := errors.New("error sending request")
-			mockCache.On("Get", source).Return(etag, true)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
 			httpClient.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusBadRequest(), errorRequest)
-			mockCache.On("Set", source, etag, int64(1)).Times(1).Return(true)
-			mockCache.On("Get", etag).Return(getManifestsCached(), true)
 			manifestCache := cache.New(mockCache, httpClient)
-			manifests, err := manifestCache.GetManifests(source)
-			assert.Equal(GinkgoT(), err, errorRequest)
+			manifests, err := manifestCache.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, errorRequest)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUpstream)
+			assert.Equal(GinkgoT(), len(manifests), 0)
+		})
+	})
+
+	Context("When the request is done with a context", func() {
+		It("should send the conditional request with the context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			httpClient.On("Do", mock.MatchedBy(func(request *http.Request) bool {
+				return request.Context() == ctx
+			})).Return(nil, context.Canceled)
+			manifestCache := cache.New(mockCache, httpClient)
+			manifests, err := manifestCache.GetManifestsContext(ctx, key)
+			assert.ErrorIs(GinkgoT(), err, context.Canceled)
+			assert.Equal(GinkgoT(), len(manifests), 0)
+		})
+	})
+
+	Context("When the upstream API responds with an error status", func() {
+		It("should return an uncacheable upstream error with the status", func() {
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			httpClient.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusBadRequest(), nil)
+			manifestCache := cache.New(mockCache, httpClient)
+			manifests, err := manifestCache.GetManifests(key)
+			var upstreamError *cache.UpstreamError
+			assert.True(GinkgoT(), errors.As(err, &upstreamError))
+			assert.Equal(GinkgoT(), http.StatusBadRequest, upstreamError.StatusCode)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUncacheable)
+			assert.NotErrorIs(GinkgoT(), err, cache.ErrUpstream)
 			assert.Equal(GinkgoT(), len(manifests), 0)
 		})
 	})
 
+	Context("When the upstream API refuses the credentials", func() {
+		It("should return an unauthorized upstream error and count it", func() {
+			metrics := cache.NewMetrics()
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: http.StatusUnauthorized}, nil)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithMetrics(metrics))
+			_, err := manifestCache.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUnauthorized)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUpstream)
+			assert.NotErrorIs(GinkgoT(), err, cache.ErrUncacheable)
+			assert.Equal(GinkgoT(), uint64(1), metrics.Stats().UpstreamErrors)
+		})
+	})
+
+	Context("When the manifests of the revision are not cached yet", func() {
+		It("should return ErrNotCached", func() {
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag}, true)
+			httpClient.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(etag), nil)
+			manifestCache := cache.New(mockCache, httpClient)
+			_, err := manifestCache.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+		})
+	})
+
+	Context("When the source is not a repository", func() {
+		It("should return ErrInvalidSource", func() {
+			localKey := cache.NewKey("./manifests", "overlays/dev", "")
+			manifestCache := cache.New(mockCache, httpClient)
+			_, err := manifestCache.GetManifests(localKey)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrInvalidSource)
+			mockCache.AssertNotCalled(GinkgoT(), "Get", mock.Anything)
+		})
+	})
+
 	Context("When is the second request for a repository and the content of repository changed", func() {
 		It("should not return cached manifests", func() {
 
-			mockCache.On("Get", source).Return(etag, true)
-			httpClient.On("Do", mock.Anything).Return(getHTTPResponse(etag), nil)
-			mockCache.On("Set", source, etag, int64(1)).Times(1).Return(true)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			httpClient.On("Do", mock.Anything).Return(getHTTPResponse("new-etag"), nil)
+			mockCache.On("Set", key.String(), cache.Entry{Revision: "new-etag"}, cache.EntryCost(cache.Entry{Revision: "new-etag"})).Times(1).Return(true)
 			manifestCache := cache.New(mockCache, httpClient)
-			manifests, err := manifestCache.GetManifests(source)
-			assert.Equal(GinkgoT(), err, errors.New("resource modified, should download it again"))
+			manifests, err := manifestCache.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrModified)
 			assert.Equal(GinkgoT(), len(manifests), 0)
 		})
 	})
 
+	Context("When there is a revision provider registered to the source host", func() {
+		It("should detect changes with the provider of the host", func() {
+			provider := new(mocks.RevisionProvider)
+			gitlabKey := cache.NewKey("gitlab.example.com/org/repo", "overlays/dev", "")
+			mockCache.On("Get", gitlabKey.String()).Return(cache.Entry{Revision: "sha", Manifests: getManifestsCached()}, true)
+			provider.On("Revision", mock.Anything, gitlabKey, "sha").Return("sha", nil)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("gitlab.example.com", provider))
+			manifests, err := manifestCache.GetManifests(gitlabKey)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.Equal(GinkgoT(), len(manifests), 1)
+			httpClient.AssertNotCalled(GinkgoT(), "Do", mock.Anything)
+		})
+	})
+
+	Context("When there is a default revision provider", func() {
+		It("should detect changes of sources of unknown hosts with it", func() {
+			provider := new(mocks.RevisionProvider)
+			key := cache.NewKey("example.com/org/source", "overlays/dev", "")
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: "sha", Manifests: getManifestsCached()}, true)
+			provider.On("Revision", mock.Anything, key, "sha").Return("other-sha", nil)
+			mockCache.On("Set", key.String(), cache.Entry{Revision: "other-sha"}, cache.EntryCost(cache.Entry{Revision: "other-sha"})).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithDefaultRevisionProvider(provider))
+			manifests, err := manifestCache.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrModified)
+			assert.Equal(GinkgoT(), len(manifests), 0)
+			httpClient.AssertNotCalled(GinkgoT(), "Do", mock.Anything)
+		})
+	})
+
+	Context("When the revision provider is rate limited and there are manifests on cache", func() {
+		It("should return the cached manifests", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			provider.On("Revision", mock.Anything, key, etag).Return("", &cache.RateLimitError{Reset: time.Now().Add(time.Hour)})
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider))
+			manifests, err := manifestCache.GetManifests(key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.Equal(GinkgoT(), len(manifests), 1)
+		})
+	})
+
+	Context("When the revision provider is rate limited on the first request", func() {
+		It("should return ErrRateLimited and store an entry without revision", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(nil, false)
+			provider.On("Revision", mock.Anything, key, "").Return("", &cache.RateLimitError{Reset: time.Now().Add(time.Hour)})
+			mockCache.On("Set", key.String(), cache.Entry{}, cache.EntryCost(cache.Entry{})).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider))
+			manifests, err := manifestCache.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrRateLimited)
+			assert.Equal(GinkgoT(), len(manifests), 0)
+			mockCache.AssertExpectations(GinkgoT())
+		})
+	})
+
+	Context("When the revision check fails and the wrapper serves stale manifests on error", func() {
+		It("should return the cached manifests marked as stale", func() {
+			errorRequest := errors.New("error sending request")
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			httpClient.On("Do", mock.Anything).Return(nil, errorRequest)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithStaleIfError())
+			result, err := manifestCache.Lookup(context.Background(), key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.True(GinkgoT(), result.Stale)
+			assert.ErrorIs(GinkgoT(), result.Err, cache.ErrUpstream)
+			assert.Equal(GinkgoT(), len(result.Manifests), 1)
+		})
+
+		It("should return the error when there are no manifests on cache", func() {
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag}, true)
+			httpClient.On("Do", mock.Anything).Return(nil, errors.New("error sending request"))
+			manifestCache := cache.New(mockCache, httpClient, cache.WithStaleIfError())
+			result, err := manifestCache.Lookup(context.Background(), key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUpstream)
+			assert.False(GinkgoT(), result.Stale)
+		})
+
+		It("should return the error when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			httpClient.On("Do", mock.Anything).Return(nil, context.Canceled)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithStaleIfError())
+			_, err := manifestCache.Lookup(ctx, key)
+			assert.ErrorIs(GinkgoT(), err, context.Canceled)
+		})
+	})
+
+	Context("When the entry was validated within the max age", func() {
+		It("should return the cached manifests without checking the revision", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached(), Validated: time.Now()}, true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider), cache.WithMaxAge(time.Minute))
+			result, err := manifestCache.Lookup(context.Background(), key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.False(GinkgoT(), result.Stale)
+			assert.Equal(GinkgoT(), len(result.Manifests), 1)
+			provider.AssertNotCalled(GinkgoT(), "Revision", mock.Anything, mock.Anything, mock.Anything)
+		})
+	})
+
+	Context("When the entry is older than the max age", func() {
+		It("should check the revision and store when it was validated", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached(), Validated: time.Now().Add(-time.Hour)}, true)
+			provider.On("Revision", mock.Anything, key, etag).Return(etag, nil)
+			mockCache.On("Set", key.String(), mock.MatchedBy(func(entry cache.Entry) bool {
+				return time.Since(entry.Validated) < time.Minute && len(entry.Manifests) == 1
+			}), mock.Anything).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider), cache.WithMaxAge(time.Minute))
+			result, err := manifestCache.Lookup(context.Background(), key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.False(GinkgoT(), result.Stale)
+			assert.Equal(GinkgoT(), len(result.Manifests), 1)
+			mockCache.AssertExpectations(GinkgoT())
+		})
+	})
+
+	Context("When the entry is older than the max age but within the stale while revalidate window", func() {
+		It("should return the cached manifests as stale and check the revision on background", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached(), Validated: time.Now().Add(-2 * time.Minute)}, true)
+			provider.On("Revision", mock.Anything, key, etag).Return("new-etag", nil)
+			revalidated := make(chan struct{})
+			mockCache.On("Set", key.String(), mock.MatchedBy(func(entry cache.Entry) bool {
+				return entry.Revision == "new-etag" && entry.Manifests == nil
+			}), mock.Anything).Times(1).Return(true).Run(func(mock.Arguments) {
+				close(revalidated)
+			})
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider),
+				cache.WithMaxAge(time.Minute), cache.WithStaleWhileRevalidate(time.Hour))
+			result, err := manifestCache.Lookup(context.Background(), key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.True(GinkgoT(), result.Stale)
+			assert.Equal(GinkgoT(), len(result.Manifests), 1)
+			select {
+			case <-revalidated:
+			case <-time.After(time.Second):
+				Fail("the revision was not checked on background")
+			}
+		})
+	})
+
+	Context("When the background revision check hangs", func() {
+		It("should give it up after the revalidate timeout and check the revision again", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached(), Validated: time.Now().Add(-2 * time.Minute)}, true)
+			var checks int32
+			provider.On("Revision", mock.Anything, key, etag).Return("", context.DeadlineExceeded).Run(func(args mock.Arguments) {
+				<-args.Get(0).(context.Context).Done()
+				atomic.AddInt32(&checks, 1)
+			})
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider),
+				cache.WithMaxAge(time.Minute), cache.WithStaleWhileRevalidate(time.Hour), cache.WithRevalidateTimeout(10*time.Millisecond))
+			result, err := manifestCache.Lookup(context.Background(), key)
+			assert.NoError(GinkgoT(), err)
+			assert.True(GinkgoT(), result.Stale)
+			assert.Eventually(GinkgoT(), func() bool {
+				_, _ = manifestCache.Lookup(context.Background(), key)
+				return atomic.LoadInt32(&checks) >= 2
+			}, time.Second, 5*time.Millisecond)
+		})
+	})
+
+	Context("When the wrapper has a token source", func() {
+		It("should authenticate the requests to the GitHub API", func() {
+			tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret"})
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			httpClient.On("Do", mock.MatchedBy(func(request *http.Request) bool {
+				return request.Header.Get("Authorization") == "Bearer secret"
+			})).Return(GetHTTPResponseWithStatusNotModified(etag), nil)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithTokenSource(tokenSource))
+			manifests, err := manifestCache.GetManifests(key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.Equal(GinkgoT(), len(manifests), 1)
+		})
+	})
+
+	Context("When the cache applies writes asynchronously", func() {
+		It("should find the manifests right after they are added", func() {
+			ristrettoCache, err := ristretto.NewCache(&ristretto.Config{
+				NumCounters: 1e4,
+				MaxCost:     1 << 20,
+				BufferItems: 64,
+			})
+			assert.NoError(GinkgoT(), err)
+			defer ristrettoCache.Close()
+			provider := new(mocks.RevisionProvider)
+			provider.On("Revision", mock.Anything, mock.Anything, mock.Anything).Return(etag, nil)
+			manifestCache := cache.New(ristrettoCache, httpClient, cache.WithRevisionProvider("github.com", provider))
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					sourceKey := cache.NewKey(fmt.Sprintf("github.com/org/source-%d", i), "overlays/dev", "")
+					_, err := manifestCache.GetManifests(sourceKey)
+					assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+					assert.NoError(GinkgoT(), manifestCache.Add(sourceKey, getManifestsCached()))
+					manifests, err := manifestCache.GetManifests(sourceKey)
+					assert.NoError(GinkgoT(), err)
+					assert.Equal(GinkgoT(), 1, len(manifests))
+				}(i)
+			}
+			wg.Wait()
+		})
+	})
+
+	Context("when computing the cost of entries", func() {
+		It("should weight them by the size of the revision and manifests", func() {
+			revision := cache.EntryCost(cache.Entry{Revision: etag})
+			manifests := cache.EntryCost(cache.Entry{Revision: etag, Manifests: getManifestsCached()})
+			assert.Equal(GinkgoT(), int64(len(etag)), revision)
+			assert.Greater(GinkgoT(), manifests, revision+100)
+			assert.Equal(GinkgoT(), int64(1), cache.EntryCost(cache.Entry{}))
+		})
+	})
+
+	Context("When the manifests returned from cache are changed", func() {
+		It("should not change the manifests on cache", func() {
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached()}, true)
+			httpClient.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(etag), nil)
+			manifestCache := cache.New(mockCache, httpClient)
+			manifests, err := manifestCache.GetManifests(key)
+			assert.Equal(GinkgoT(), err, nil)
+			manifests[0].SetNamespace("changed")
+			manifests[0].SetLabels(map[string]string{"changed": "true"})
+
+			manifests, err = manifestCache.GetManifests(key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.Equal(GinkgoT(), getManifestsCached(), manifests)
+		})
+	})
+
+	Context("When the manifests added to cache are changed", func() {
+		It("should not change the manifests on cache", func() {
+			var stored cache.Entry
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag}, true)
+			mockCache.On("Set", key.String(), mock.Anything, mock.Anything).Return(true).Run(func(args mock.Arguments) {
+				stored = args.Get(1).(cache.Entry)
+			})
+			manifests := getManifestsCached()
+			manifestCache := cache.New(mockCache, httpClient)
+			assert.Equal(GinkgoT(), manifestCache.Add(key, manifests), nil)
+			manifests[0].SetNamespace("changed")
+			assert.Equal(GinkgoT(), getManifestsCached(), stored.Manifests)
+		})
+	})
+
+	Context("when the wrapper has a cost function", func() {
+		It("should set the manifests with the cost it returns", func() {
+			entry := withSize(cache.Entry{Revision: etag, Manifests: getManifestsCached()})
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag}, true)
+			mockCache.On("Set", key.String(), entry, int64(42)).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithCostFunc(func(cache.Entry) int64 {
+				return 42
+			}))
+			err := manifestCache.Add(key, getManifestsCached())
+			assert.Equal(GinkgoT(), err, nil)
+			mockCache.AssertExpectations(GinkgoT())
+		})
+	})
+
+	Context("when manifests built by callers are copied", func() {
+		It("should copy values unstructured can't deep copy", func() {
+			manifests := []unstructured.Unstructured{{Object: map[string]interface{}{"kind": "Deployment", "spec": map[string]interface{}{"replicas": 2}}}}
+			copies, err := cache.CopyManifests(manifests)
+			assert.NoError(GinkgoT(), err)
+			copies[0].SetKind("StatefulSet")
+			assert.Equal(GinkgoT(), "Deployment", manifests[0].GetKind())
+			replicas, _, _ := unstructured.NestedInt64(copies[0].Object, "spec", "replicas")
+			assert.Equal(GinkgoT(), int64(2), replicas)
+		})
+	})
+
+	Context("when the entry has the size of its manifests", func() {
+		It("should cost the size without serializing the manifests", func() {
+			entry := cache.Entry{Revision: etag, Manifests: getManifestsCached(), Size: 100}
+			assert.Equal(GinkgoT(), int64(len(etag)+100), cache.EntryCost(entry))
+		})
+	})
+
+	Context("When the wrapper scopes revisions to paths", func() {
+		It("should add the manifests with the paths they were rendered from and the revision fetched before", func() {
+			provider := new(mocks.PathRevisionProvider)
+			paths := []string{"base", "overlays/dev"}
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag}, true)
+			mockCache.On("Set", key.String(), mock.MatchedBy(func(entry cache.Entry) bool {
+				return entry.Revision == etag && !entry.Scoped && assert.ObjectsAreEqual(paths, entry.Paths) && len(entry.Manifests) == 1
+			}), mock.Anything).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider), cache.WithPathScopedRevisions())
+			err := manifestCache.AddWithPaths(context.Background(), key, getManifestsCached(), paths)
+			assert.Equal(GinkgoT(), err, nil)
+			mockCache.AssertExpectations(GinkgoT())
+			provider.AssertNotCalled(GinkgoT(), "PathRevision", mock.Anything, mock.Anything, mock.Anything)
+		})
+
+		It("should keep the revision scoped when the render read the same paths", func() {
+			provider := new(mocks.PathRevisionProvider)
+			paths := []string{"overlays/dev"}
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: "paths:abc", Paths: paths, Scoped: true}, true)
+			mockCache.On("Set", key.String(), mock.MatchedBy(func(entry cache.Entry) bool {
+				return entry.Revision == "paths:abc" && entry.Scoped
+			}), mock.Anything).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider), cache.WithPathScopedRevisions())
+			err := manifestCache.AddWithPaths(context.Background(), key, getManifestsCached(), paths)
+			assert.Equal(GinkgoT(), err, nil)
+			mockCache.AssertExpectations(GinkgoT())
+		})
+
+		It("should scope the revision to the paths once the repository is unchanged", func() {
+			provider := new(mocks.PathRevisionProvider)
+			paths := []string{"overlays/dev"}
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Paths: paths, Manifests: getManifestsCached()}, true)
+			provider.On("PathRevision", mock.Anything, key, paths).Return("paths:abc", nil)
+			provider.On("Revision", mock.Anything, key, etag).Return(etag, nil)
+			mockCache.On("Set", key.String(), mock.MatchedBy(func(entry cache.Entry) bool {
+				return entry.Revision == "paths:abc" && entry.Scoped && len(entry.Manifests) == 1
+			}), mock.Anything).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider), cache.WithPathScopedRevisions())
+			result, err := manifestCache.Lookup(context.Background(), key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.Equal(GinkgoT(), len(result.Manifests), 1)
+			mockCache.AssertExpectations(GinkgoT())
+		})
+
+		It("should validate the entries scoped to paths against the revision of their paths", func() {
+			provider := new(mocks.PathRevisionProvider)
+			paths := []string{"overlays/dev"}
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: "paths:abc", Paths: paths, Scoped: true, Manifests: getManifestsCached()}, true)
+			provider.On("PathRevision", mock.Anything, key, paths).Return("paths:abc", nil)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider), cache.WithPathScopedRevisions())
+			result, err := manifestCache.Lookup(context.Background(), key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.Equal(GinkgoT(), len(result.Manifests), 1)
+			provider.AssertNotCalled(GinkgoT(), "Revision", mock.Anything, mock.Anything, mock.Anything)
+		})
+	})
+
+	Context("When the revision of manifests rendered from known files changes", func() {
+		It("should keep the manifests as outdated until they are rendered again or reused", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached(), Files: []string{"overlays/dev/kustomization.yaml"}, Digest: "digest"}, true)
+			provider.On("Revision", mock.Anything, key, etag).Return("new-etag", nil)
+			mockCache.On("Set", key.String(), mock.MatchedBy(func(entry cache.Entry) bool {
+				return entry.Revision == "new-etag" && entry.Outdated && entry.Digest == "digest" && len(entry.Manifests) == 1
+			}), mock.Anything).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider))
+			_, err := manifestCache.Lookup(context.Background(), key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrModified)
+			mockCache.AssertExpectations(GinkgoT())
+		})
+	})
+
+	Context("When the manifests were rendered from remote bases", func() {
+		remote := "github.com/org/base//deploy?ref=main"
+		entry := func() cache.Entry {
+			return cache.Entry{Revision: etag, Manifests: getManifestsCached(), Remotes: map[string]string{remote: "base-etag"}}
+		}
+
+		It("should return the manifests when the remote bases are unchanged", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(entry(), true)
+			provider.On("Revision", mock.Anything, key, etag).Return(etag, nil)
+			provider.On("Revision", mock.Anything, cache.NewKey(remote, "", ""), "base-etag").Return("base-etag", nil)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider))
+			result, err := manifestCache.Lookup(context.Background(), key)
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), 1, len(result.Manifests))
+		})
+
+		It("should return ErrModified when a remote base changed", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(entry(), true)
+			provider.On("Revision", mock.Anything, key, etag).Return(etag, nil)
+			provider.On("Revision", mock.Anything, cache.NewKey(remote, "", ""), "base-etag").Return("new-base-etag", nil)
+			mockCache.On("Set", key.String(), cache.Entry{Revision: etag}, mock.Anything).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider))
+			_, err := manifestCache.Lookup(context.Background(), key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrModified)
+			mockCache.AssertExpectations(GinkgoT())
+		})
+
+		It("should return ErrModified when the remote base can't be checked", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(entry(), true)
+			provider.On("Revision", mock.Anything, key, etag).Return(etag, nil)
+			provider.On("Revision", mock.Anything, cache.NewKey(remote, "", ""), "base-etag").Return("", &cache.UpstreamError{URL: "https://api.github.com", StatusCode: 502})
+			mockCache.On("Set", key.String(), cache.Entry{Revision: etag}, mock.Anything).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider), cache.WithStaleIfError())
+			_, err := manifestCache.Lookup(context.Background(), key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrModified)
+		})
+
+		It("should return ErrModified when the revision of the remote base is unknown", func() {
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag, Manifests: getManifestsCached(), Remotes: map[string]string{remote: ""}}, true)
+			provider.On("Revision", mock.Anything, key, etag).Return(etag, nil)
+			mockCache.On("Set", key.String(), cache.Entry{Revision: etag}, mock.Anything).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider))
+			_, err := manifestCache.Lookup(context.Background(), key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrModified)
+			provider.AssertNumberOfCalls(GinkgoT(), "Revision", 1)
+		})
+	})
+
+	Context("When the outdated manifests are reused", func() {
+		outdated := func() cache.Entry {
+			return cache.Entry{Revision: "new-etag", Manifests: getManifestsCached(), Files: []string{"overlays/dev/kustomization.yaml"}, Digest: "digest", Outdated: true}
+		}
+
+		It("should report the inputs they were rendered from", func() {
+			mockCache.On("Get", key.String()).Return(outdated(), true)
+			manifestCache := cache.New(mockCache, httpClient)
+			inputs, ok := manifestCache.PreviousInputs(key)
+			assert.True(GinkgoT(), ok)
+			assert.Equal(GinkgoT(), "digest", inputs.Digest)
+			assert.Equal(GinkgoT(), []string{"overlays/dev/kustomization.yaml"}, inputs.Files)
+		})
+
+		It("should store them as the manifests of the new revision when the digest matches", func() {
+			mockCache.On("Get", key.String()).Return(outdated(), true)
+			mockCache.On("Set", key.String(), mock.MatchedBy(func(entry cache.Entry) bool {
+				return entry.Revision == "new-etag" && !entry.Outdated && len(entry.Manifests) == 1
+			}), mock.Anything).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient)
+			manifests, err := manifestCache.Reuse(key, "digest")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), 1, len(manifests))
+			mockCache.AssertExpectations(GinkgoT())
+		})
+
+		It("should return ErrNotCached when the digest differs", func() {
+			mockCache.On("Get", key.String()).Return(outdated(), true)
+			manifestCache := cache.New(mockCache, httpClient)
+			_, err := manifestCache.Reuse(key, "other")
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+			mockCache.AssertNotCalled(GinkgoT(), "Set", mock.Anything, mock.Anything, mock.Anything)
+		})
+
+		It("should not be served by lookups", func() {
+			provider := new(mocks.RevisionProvider)
+			provider.On("Revision", mock.Anything, key, "new-etag").Return("new-etag", nil)
+			mockCache.On("Get", key.String()).Return(outdated(), true)
+			manifestCache := cache.New(mockCache, httpClient, cache.WithRevisionProvider("github.com", provider))
+			_, err := manifestCache.Lookup(context.Background(), key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+		})
+	})
+
+	Context("When manifests are added with their inputs", func() {
+		It("should store the files and digest they were rendered from", func() {
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag}, true)
+			entry := withSize(cache.Entry{Revision: etag, Manifests: getManifestsCached(), Files: []string{"overlays/dev/kustomization.yaml"}, Digest: "digest"})
+			mockCache.On("Set", key.String(), entry, cache.EntryCost(entry)).Times(1).Return(true)
+			manifestCache := cache.New(mockCache, httpClient)
+			err := manifestCache.AddInputs(context.Background(), key, getManifestsCached(), cache.Inputs{Files: entry.Files, Digest: "digest"})
+			assert.NoError(GinkgoT(), err)
+			mockCache.AssertExpectations(GinkgoT())
+		})
+	})
+
 	Context("when there is no error on cache operations", func() {
 		It("should add manifests to cache successfully", func() {
 
-			mockCache.On("Get", source).Return(etag, true)
-			mockCache.On("Set", etag, getManifestsCached(), int64(1)).Times(1).Return(true)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag}, true)
+			entry := withSize(cache.Entry{Revision: etag, Manifests: getManifestsCached()})
+			mockCache.On("Set", key.String(), entry, cache.EntryCost(entry)).Times(1).Return(true)
 			manifestCache := cache.New(mockCache, httpClient)
-			err := manifestCache.Add(source, getManifestsCached())
+			err := manifestCache.Add(key, getManifestsCached())
 			assert.Equal(GinkgoT(), err, nil)
 		})
 	})
@@ -92,26 +646,34 @@ var _ = Describe("Cache", func() {
 	Context("when fails to get a key on cache", func() {
 		It("should return error", func() {
 
-			mockCache.On("Get", source).Return(nil, false)
-			//mockCache.On("Set", etag, getManifestsCached(), int64(1)).Times(1).Return(true)
+			mockCache.On("Get", key.String()).Return(nil, false)
 			manifestCache := cache.New(mockCache, httpClient)
-			err := manifestCache.Add(source, getManifestsCached())
-			assert.Equal(GinkgoT(), err, errors.New("error getting etag on cache"))
+			err := manifestCache.Add(key, getManifestsCached())
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUncacheable)
 		})
 	})
 
 	Context("when fails to set a key on cache", func() {
 		It("should return error", func() {
 
-			mockCache.On("Get", source).Return(etag, true)
-			mockCache.On("Set", etag, getManifestsCached(), int64(1)).Times(1).Return(false)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: etag}, true)
+			entry := withSize(cache.Entry{Revision: etag, Manifests: getManifestsCached()})
+			mockCache.On("Set", key.String(), entry, cache.EntryCost(entry)).Times(1).Return(false)
 			manifestCache := cache.New(mockCache, httpClient)
-			err := manifestCache.Add(source, getManifestsCached())
-			assert.Equal(GinkgoT(), err, errors.New("failed to set manifests to cache"))
+			err := manifestCache.Add(key, getManifestsCached())
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUncacheable)
 		})
 	})
 })
 
+// withSize returns the entry with the Size the wrapper computes when it stores the manifests
+func withSize(entry cache.Entry) cache.Entry {
+	manifests, err := json.Marshal(entry.Manifests)
+	assert.NoError(GinkgoT(), err)
+	entry.Size = int64(len(manifests))
+	return entry
+}
+
 func getManifestsCached() []unstructured.Unstructured {
 	manifests := make([]unstructured.Unstructured, 0)
 	deployment := unstructured.Unstructured{
@@ -122,7 +684,7 @@ func getManifestsCached() []unstructured.Unstructured {
 				"name": "demo-deployment",
 			},
 			"spec": map[string]interface{}{
-				"replicas": 2,
+				"replicas": int64(2),
 				"selector": map[string]interface{}{
 					"matchLabels": map[string]interface{}{
 						"app": "demo",
@@ -135,15 +697,15 @@ func getManifestsCached() []unstructured.Unstructured {
 						},
 					},
 					"spec": map[string]interface{}{
-						"containers": []map[string]interface{}{
-							{
+						"containers": []interface{}{
+							map[string]interface{}{
 								"name":  "web",
 								"image": "nginx:1.12",
-								"ports": []map[string]interface{}{
-									{
+								"ports": []interface{}{
+									map[string]interface{}{
 										"name":          "http",
 										"protocol":      "TCP",
-										"containerPort": 80,
+										"containerPort": int64(80),
 									},
 								},
 							},
@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Codec encodes the manifests stored on cache, trading the memory of live unstructured maps for the
+// time spent decoding them on every lookup
+type Codec interface {
+	Encode(manifests []unstructured.Unstructured) ([]byte, error)
+	Decode(data []byte) ([]unstructured.Unstructured, error)
+}
+
+// JSONCodec stores the manifests as json
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(manifests []unstructured.Unstructured) ([]byte, error) {
+	data, err := json.Marshal(manifests)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding manifests: %w", err)
+	}
+	return data, nil
+}
+
+func (JSONCodec) Decode(data []byte) ([]unstructured.Unstructured, error) {
+	var manifests []unstructured.Unstructured
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return nil, fmt.Errorf("error decoding manifests: %w", err)
+	}
+	return manifests, nil
+}
+
+// GzipCodec stores the manifests as gzip compressed json
+type GzipCodec struct {
+	// Level is the gzip compression level, e.g. gzip.BestSpeed or gzip.NoCompression,
+	// gzip.DefaultCompression when nil
+	Level *int
+}
+
+func (c GzipCodec) Encode(manifests []unstructured.Unstructured) ([]byte, error) {
+	data, err := JSONCodec{}.Encode(manifests)
+	if err != nil {
+		return nil, err
+	}
+	level := gzip.DefaultCompression
+	if c.Level != nil {
+		level = *c.Level
+	}
+	var buffer bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buffer, level)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding manifests: %w", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("error encoding manifests: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("error encoding manifests: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (GzipCodec) Decode(data []byte) ([]unstructured.Unstructured, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding manifests: %w", err)
+	}
+	defer reader.Close()
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding manifests: %w", err)
+	}
+	return JSONCodec{}.Decode(decompressed)
+}
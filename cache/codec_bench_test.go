@@ -0,0 +1,119 @@
+package cache_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// BenchmarkCodec measures the time to store and read back a large render with each codec, against the copies
+// the wrapper stores without a codec, reporting the size of the encoded manifests and the heap the stored value retains
+func BenchmarkCodec(b *testing.B) {
+	manifests := largeRender(500)
+	fast := gzip.BestSpeed
+	b.Run("none", func(b *testing.B) {
+		b.ReportAllocs()
+		var stored []unstructured.Unstructured
+		for i := 0; i < b.N; i++ {
+			var err error
+			stored, err = cache.CopyManifests(manifests)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := cache.CopyManifests(stored); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(retainedHeap(b, func() interface{} {
+			copies, _ := cache.CopyManifests(manifests)
+			return copies
+		})), "retained-bytes")
+	})
+	for name, codec := range map[string]cache.Codec{
+		"json":      cache.JSONCodec{},
+		"gzip":      cache.GzipCodec{},
+		"gzip-fast": cache.GzipCodec{Level: &fast},
+	} {
+		codec := codec
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			var data []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				data, err = codec.Encode(manifests)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := codec.Decode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "stored-bytes")
+			b.ReportMetric(float64(retainedHeap(b, func() interface{} {
+				data, _ := codec.Encode(manifests)
+				return data
+			})), "retained-bytes")
+		})
+	}
+}
+
+// BenchmarkCodecDecode measures the time added to each cache hit by the codec, against the copy made without one
+func BenchmarkCodecDecode(b *testing.B) {
+	manifests := largeRender(500)
+	b.Run("none", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := cache.CopyManifests(manifests); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for name, codec := range map[string]cache.Codec{"json": cache.JSONCodec{}, "gzip": cache.GzipCodec{}} {
+		data, err := codec.Encode(manifests)
+		if err != nil {
+			b.Fatal(err)
+		}
+		codec := codec
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Decode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// retainedHeap returns the heap still in use by the value built by store after a garbage collection,
+// the memory an entry holding it keeps on cache
+func retainedHeap(b *testing.B, store func() interface{}) uint64 {
+	b.StopTimer()
+	defer b.StartTimer()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	value := store()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(value)
+	if after.HeapAlloc < before.HeapAlloc {
+		return 0
+	}
+	return after.HeapAlloc - before.HeapAlloc
+}
+
+func largeRender(size int) []unstructured.Unstructured {
+	manifests := make([]unstructured.Unstructured, 0, size)
+	for i := 0; i < size; i++ {
+		manifest := getManifestsCached()[0]
+		manifest.SetName(fmt.Sprintf("demo-deployment-%d", i))
+		manifest.SetLabels(map[string]string{"app": "demo", "component": fmt.Sprintf("component-%d", i%10)})
+		manifests = append(manifests, manifest)
+	}
+	return manifests
+}
@@ -0,0 +1,70 @@
+package cache_test
+
+import (
+	"compress/gzip"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"github.com/thallesfreitaszup/lib-kustomize/cache/mocks"
+)
+
+var _ = Describe("Codec", func() {
+	for name, codec := range map[string]cache.Codec{"json": cache.JSONCodec{}, "gzip": cache.GzipCodec{}} {
+		codec := codec
+		Context("when the manifests are encoded with the "+name+" codec", func() {
+			It("should decode the same manifests", func() {
+				data, err := codec.Encode(getManifestsCached())
+				assert.NoError(GinkgoT(), err)
+				manifests, err := codec.Decode(data)
+				assert.NoError(GinkgoT(), err)
+				assert.Equal(GinkgoT(), getManifestsCached(), manifests)
+			})
+		})
+	}
+
+	Context("when the gzip codec has no compression", func() {
+		It("should store the json without compressing it", func() {
+			level := gzip.NoCompression
+			data, err := cache.GzipCodec{Level: &level}.Encode(largeRender(50))
+			assert.NoError(GinkgoT(), err)
+			compressed, err := cache.GzipCodec{}.Encode(largeRender(50))
+			assert.NoError(GinkgoT(), err)
+			assert.Greater(GinkgoT(), len(data), 2*len(compressed))
+			manifests, err := cache.GzipCodec{}.Decode(data)
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), largeRender(50), manifests)
+		})
+	})
+
+	Context("when the data is not encoded by the codec", func() {
+		It("should return error", func() {
+			_, err := cache.GzipCodec{}.Decode([]byte("[]"))
+			assert.Error(GinkgoT(), err)
+		})
+	})
+
+	Context("when the wrapper has a codec", func() {
+		It("should store the manifests encoded and decode them on lookups", func() {
+			var stored cache.Entry
+			key := cache.NewKey("github.com/org/source", "overlays/dev", "")
+			mockCache := new(mocks.Cache)
+			httpClient := new(mocks.HttpClient)
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: "etag"}, true).Once()
+			mockCache.On("Set", key.String(), mock.Anything, mock.Anything).Return(true).Run(func(args mock.Arguments) {
+				stored = args.Get(1).(cache.Entry)
+			})
+			manifestCache := cache.New(mockCache, httpClient, cache.WithCodec(cache.GzipCodec{}))
+			assert.NoError(GinkgoT(), manifestCache.Add(key, getManifestsCached()))
+			assert.Nil(GinkgoT(), stored.Manifests)
+			assert.NotEmpty(GinkgoT(), stored.Encoded)
+
+			mockCache.On("Get", key.String()).Return(stored, true)
+			httpClient.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified("etag"), nil)
+			manifests, err := manifestCache.GetManifests(key)
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), getManifestsCached(), manifests)
+		})
+	})
+})
@@ -0,0 +1,84 @@
+// Package collector exports the metrics of a cache.Wrapper to Prometheus
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+)
+
+// Statser is implemented by cache.Wrapper and cache.Metrics
+type Statser interface {
+	Stats() cache.Stats
+}
+
+// Collector is a prometheus.Collector reading the stats of a wrapper on each scrape, e.g.
+//
+//	prometheus.MustRegister(collector.New(wrapper, "app"))
+type Collector struct {
+	statser        Statser
+	hits           *prometheus.Desc
+	misses         *prometheus.Desc
+	revisionChecks *prometheus.Desc
+	notModified    *prometheus.Desc
+	upstreamErrors *prometheus.Desc
+	rateLimited    *prometheus.Desc
+	evictions      *prometheus.Desc
+	bytesStored    *prometheus.Desc
+	lastValidated  *prometheus.Desc
+	lastRendered   *prometheus.Desc
+}
+
+// New instantiates a collector of the stats of statser, the metric names are prefixed with namespace
+// when it is not empty
+func New(statser Statser, namespace string) *Collector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "manifests_cache", name), help, labels, nil)
+	}
+	return &Collector{
+		statser:        statser,
+		hits:           desc("hits_total", "Lookups that returned manifests from cache, stale ones included."),
+		misses:         desc("misses_total", "Lookups that returned no manifests, so the source had to be rendered."),
+		revisionChecks: desc("revision_checks_total", "Revisions fetched from the revision providers, e.g. GitHub API calls."),
+		notModified:    desc("not_modified_total", "Revision checks that found the source unchanged."),
+		upstreamErrors: desc("upstream_errors_total", "Revision checks that failed upstream."),
+		rateLimited:    desc("rate_limited_total", "Revision checks refused because the provider is rate limited."),
+		evictions:      desc("evictions_total", "Entries evicted by the cache."),
+		bytesStored:    desc("stored_bytes", "Cost of the entries stored, their size in bytes unless the wrapper has a cost function. Only evictions reported to OnEvict, like the ones of ristretto, are subtracted."),
+		lastValidated:  desc("last_validated_timestamp_seconds", "When the revision of the source was last checked.", "source"),
+		lastRendered:   desc("last_rendered_timestamp_seconds", "When the manifests of the source were last rendered.", "source"),
+	}
+}
+
+// Describe sends the descriptors of the metrics of the collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{c.hits, c.misses, c.revisionChecks, c.notModified, c.upstreamErrors,
+		c.rateLimited, c.evictions, c.bytesStored, c.lastValidated, c.lastRendered} {
+		ch <- desc
+	}
+}
+
+// Collect sends the metrics of a snapshot of the stats
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.statser.Stats()
+	counters := map[*prometheus.Desc]uint64{
+		c.hits:           stats.Hits,
+		c.misses:         stats.Misses,
+		c.revisionChecks: stats.RevisionChecks,
+		c.notModified:    stats.NotModified,
+		c.upstreamErrors: stats.UpstreamErrors,
+		c.rateLimited:    stats.RateLimited,
+		c.evictions:      stats.Evictions,
+	}
+	for desc, value := range counters {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value))
+	}
+	ch <- prometheus.MustNewConstMetric(c.bytesStored, prometheus.GaugeValue, float64(stats.BytesStored))
+	for source, sourceStats := range stats.Sources {
+		if !sourceStats.LastValidated.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.lastValidated, prometheus.GaugeValue, float64(sourceStats.LastValidated.Unix()), source)
+		}
+		if !sourceStats.LastRendered.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.lastRendered, prometheus.GaugeValue, float64(sourceStats.LastRendered.Unix()), source)
+		}
+	}
+}
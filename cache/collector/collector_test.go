@@ -0,0 +1,60 @@
+package collector_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"github.com/thallesfreitaszup/lib-kustomize/cache/collector"
+	"strings"
+	"time"
+)
+
+type stats cache.Stats
+
+func (s stats) Stats() cache.Stats {
+	return cache.Stats(s)
+}
+
+var _ = Describe("Collector", func() {
+	Context("when it is scraped", func() {
+		It("should export the stats of the wrapper", func() {
+			validated := time.Unix(1650000000, 0)
+			c := collector.New(stats{
+				Hits:           3,
+				Misses:         1,
+				RevisionChecks: 4,
+				NotModified:    2,
+				UpstreamErrors: 1,
+				BytesStored:    512,
+				Sources: map[string]cache.SourceStats{
+					"github.com/org/repo": {LastValidated: validated},
+				},
+			}, "app")
+			registry := prometheus.NewPedanticRegistry()
+			assert.NoError(GinkgoT(), registry.Register(c))
+
+			expected := `
+# HELP app_manifests_cache_hits_total Lookups that returned manifests from cache, stale ones included.
+# TYPE app_manifests_cache_hits_total counter
+app_manifests_cache_hits_total 3
+# HELP app_manifests_cache_misses_total Lookups that returned no manifests, so the source had to be rendered.
+# TYPE app_manifests_cache_misses_total counter
+app_manifests_cache_misses_total 1
+# HELP app_manifests_cache_stored_bytes Cost of the entries stored, their size in bytes unless the wrapper has a cost function. Only evictions reported to OnEvict, like the ones of ristretto, are subtracted.
+# TYPE app_manifests_cache_stored_bytes gauge
+app_manifests_cache_stored_bytes 512
+# HELP app_manifests_cache_last_validated_timestamp_seconds When the revision of the source was last checked.
+# TYPE app_manifests_cache_last_validated_timestamp_seconds gauge
+app_manifests_cache_last_validated_timestamp_seconds{source="github.com/org/repo"} 1.65e+09
+`
+			assert.NoError(GinkgoT(), testutil.GatherAndCompare(registry, strings.NewReader(expected),
+				"app_manifests_cache_hits_total", "app_manifests_cache_misses_total", "app_manifests_cache_stored_bytes",
+				"app_manifests_cache_last_validated_timestamp_seconds"))
+			count, err := testutil.GatherAndCount(registry, "app_manifests_cache_last_rendered_timestamp_seconds")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), 0, count)
+		})
+	})
+})
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const diskEntryExt = ".json"
+
+// DiskCache is a Cache that stores each Entry as a json file under a directory, so the revisions and
+// manifests survive restarts. Files are written atomically and the least recently used ones are evicted
+// once the size of the directory goes over the cap
+type DiskCache struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+	// size is the size of the entries under the directory, tracked on writes so it is only listed to evict
+	size int64
+}
+
+// NewDiskCache instantiates a cache storing its entries under dir, creating it when missing.
+// maxSize is the cap in bytes of the stored entries, there is no cap when it is not positive
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+	// temporary files are left behind when the process dies while writing
+	temps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, temp := range temps {
+		_ = os.Remove(temp)
+	}
+	c := &DiskCache{dir: dir, maxSize: maxSize}
+	entries, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		c.size += entry.Size()
+	}
+	return c, nil
+}
+
+// Get returns the Entry stored under the key, entries that can't be read are reported as missing
+func (c *DiskCache) Get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	file := c.file(key)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(file, now, now)
+	return entry, true
+}
+
+// Set stores the Entry under the key, the cost is ignored as entries are weighted by their size on disk.
+// It returns false when the value is not an Entry or can't be written
+func (c *DiskCache) Set(key, value interface{}, _ int64) bool {
+	entry, ok := value.(Entry)
+	if !ok {
+		return false
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return false
+	}
+	if c.maxSize > 0 && int64(len(data)) > c.maxSize {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	file := c.file(key)
+	previous := fileSize(file)
+	if err := writeFileAtomic(file, data); err != nil {
+		return false
+	}
+	c.size += int64(len(data)) - previous
+	c.evict(file)
+	return true
+}
+
+// Del removes the entry of the key
+func (c *DiskCache) Del(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	file := c.file(key)
+	size := fileSize(file)
+	if err := os.Remove(file); err == nil {
+		c.size -= size
+	}
+}
+
+// Clear removes every entry under the directory
+func (c *DiskCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, err := filepath.Glob(filepath.Join(c.dir, "*"+diskEntryExt))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		_ = os.Remove(file)
+	}
+	c.size = 0
+}
+
+// file returns the path of the entry of the key, keys are hashed as they are urls
+func (c *DiskCache) file(key interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(key)))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+diskEntryExt)
+}
+
+// evict removes the least recently used entries until the directory fits the cap, keeping the file just written.
+// The directory is only listed when the tracked size goes over the cap, and the size is synced with it then
+func (c *DiskCache) evict(keep string) {
+	if c.maxSize <= 0 || c.size <= c.maxSize {
+		return
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return
+	}
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, entry := range entries {
+		if size <= c.maxSize {
+			break
+		}
+		path := filepath.Join(c.dir, entry.Name())
+		if path == keep {
+			continue
+		}
+		if err := os.Remove(path); err == nil {
+			size -= entry.Size()
+		}
+	}
+	c.size = size
+}
+
+// entries lists the entry files under the directory
+func (c *DiskCache) entries() ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), diskEntryExt) {
+			continue
+		}
+		entries = append(entries, file)
+	}
+	return entries, nil
+}
+
+// fileSize returns the size of the file, zero when it doesn't exist
+func fileSize(file string) int64 {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// writeFileAtomic writes the data to a temporary file renamed over the file, so readers never see partial entries
+func writeFileAtomic(file string, data []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(file), "entry-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
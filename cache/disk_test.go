@@ -0,0 +1,143 @@
+package cache_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("DiskCache", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "disk-cache")
+		assert.NoError(GinkgoT(), err)
+	})
+	AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	Context("when an entry is set", func() {
+		It("should return the revision and the manifests", func() {
+			diskCache, err := cache.NewDiskCache(dir, 0)
+			assert.NoError(GinkgoT(), err)
+			assert.True(GinkgoT(), diskCache.Set("key", cache.Entry{Revision: "etag", Manifests: getManifestsCached()}, 1))
+			item, got := diskCache.Get("key")
+			assert.True(GinkgoT(), got)
+			entry := item.(cache.Entry)
+			assert.Equal(GinkgoT(), "etag", entry.Revision)
+			assert.Equal(GinkgoT(), 1, len(entry.Manifests))
+			assert.Equal(GinkgoT(), "demo-deployment", entry.Manifests[0].GetName())
+		})
+	})
+
+	Context("when the process restarts", func() {
+		It("should return the entries stored by the previous instance", func() {
+			diskCache, err := cache.NewDiskCache(dir, 0)
+			assert.NoError(GinkgoT(), err)
+			assert.True(GinkgoT(), diskCache.Set("key", cache.Entry{Revision: "etag"}, 1))
+			assert.NoError(GinkgoT(), ioutil.WriteFile(filepath.Join(dir, "entry-123.tmp"), []byte("{"), 0600))
+
+			restarted, err := cache.NewDiskCache(dir, 0)
+			assert.NoError(GinkgoT(), err)
+			item, got := restarted.Get("key")
+			assert.True(GinkgoT(), got)
+			assert.Equal(GinkgoT(), "etag", item.(cache.Entry).Revision)
+			temps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+			assert.Empty(GinkgoT(), temps)
+		})
+	})
+
+	Context("when the key is not stored", func() {
+		It("should report it as missing", func() {
+			diskCache, err := cache.NewDiskCache(dir, 0)
+			assert.NoError(GinkgoT(), err)
+			_, got := diskCache.Get("missing")
+			assert.False(GinkgoT(), got)
+		})
+	})
+
+	Context("when entries are deleted", func() {
+		It("should report them as missing", func() {
+			diskCache, err := cache.NewDiskCache(dir, 0)
+			assert.NoError(GinkgoT(), err)
+			assert.True(GinkgoT(), diskCache.Set("first", cache.Entry{Revision: "etag"}, 1))
+			assert.True(GinkgoT(), diskCache.Set("second", cache.Entry{Revision: "etag"}, 1))
+			diskCache.Del("first")
+			_, got := diskCache.Get("first")
+			assert.False(GinkgoT(), got)
+			_, got = diskCache.Get("second")
+			assert.True(GinkgoT(), got)
+			diskCache.Clear()
+			_, got = diskCache.Get("second")
+			assert.False(GinkgoT(), got)
+		})
+	})
+
+	Context("when the value is not an entry", func() {
+		It("should not store it", func() {
+			diskCache, err := cache.NewDiskCache(dir, 0)
+			assert.NoError(GinkgoT(), err)
+			assert.False(GinkgoT(), diskCache.Set("key", "value", 1))
+		})
+	})
+
+	Context("when the entries go over the size cap", func() {
+		It("should evict the least recently used entries", func() {
+			entry := cache.Entry{Revision: "etag", Manifests: getManifestsCached()}
+			diskCache, err := cache.NewDiskCache(dir, 0)
+			assert.NoError(GinkgoT(), err)
+			assert.True(GinkgoT(), diskCache.Set("size", entry, 1))
+			files, _ := ioutil.ReadDir(dir)
+			size := files[0].Size()
+			assert.NoError(GinkgoT(), os.Remove(filepath.Join(dir, files[0].Name())))
+
+			diskCache, err = cache.NewDiskCache(dir, 2*size)
+			assert.NoError(GinkgoT(), err)
+			assert.True(GinkgoT(), diskCache.Set("first", entry, 1))
+			assert.True(GinkgoT(), diskCache.Set("second", entry, 1))
+			// file times may have a coarse resolution
+			time.Sleep(10 * time.Millisecond)
+			_, got := diskCache.Get("first")
+			assert.True(GinkgoT(), got)
+			time.Sleep(10 * time.Millisecond)
+			assert.True(GinkgoT(), diskCache.Set("third", entry, 1))
+
+			_, got = diskCache.Get("second")
+			assert.False(GinkgoT(), got)
+			_, got = diskCache.Get("first")
+			assert.True(GinkgoT(), got)
+			_, got = diskCache.Get("third")
+			assert.True(GinkgoT(), got)
+		})
+
+		It("should count the entries stored by a previous instance", func() {
+			entry := cache.Entry{Revision: "etag", Manifests: getManifestsCached()}
+			diskCache, err := cache.NewDiskCache(dir, 0)
+			assert.NoError(GinkgoT(), err)
+			assert.True(GinkgoT(), diskCache.Set("first", entry, 1))
+			assert.True(GinkgoT(), diskCache.Set("second", entry, 1))
+			files, _ := ioutil.ReadDir(dir)
+			size := files[0].Size()
+
+			restarted, err := cache.NewDiskCache(dir, 2*size)
+			assert.NoError(GinkgoT(), err)
+			time.Sleep(10 * time.Millisecond)
+			assert.True(GinkgoT(), restarted.Set("third", entry, 1))
+			files, _ = ioutil.ReadDir(dir)
+			assert.Equal(GinkgoT(), 2, len(files))
+			_, got := restarted.Get("third")
+			assert.True(GinkgoT(), got)
+		})
+
+		It("should not store entries bigger than the cap", func() {
+			diskCache, err := cache.NewDiskCache(dir, 10)
+			assert.NoError(GinkgoT(), err)
+			assert.False(GinkgoT(), diskCache.Set("key", cache.Entry{Revision: "etag", Manifests: getManifestsCached()}, 1))
+		})
+	})
+})
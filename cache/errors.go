@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrNotCached is returned when there are no manifests on cache for the key, e.g. on the first request
+	ErrNotCached = errors.New("manifests not cached yet")
+	// ErrModified is returned when the source changed since the manifests on cache were rendered
+	ErrModified = errors.New("resource modified, should download it again")
+	// ErrUpstream is returned when the revision of the source could not be fetched
+	ErrUpstream = errors.New("upstream request failed")
+	// ErrUncacheable is returned when the revision of the source can't be known, like a ref missing on the remote,
+	// the manifests of such sources are rendered without being cached
+	ErrUncacheable = errors.New("source revision can't be validated")
+	// ErrRateLimited is returned when the API of the source host refuses requests until the rate limit resets
+	ErrRateLimited = errors.New("rate limited")
+	// ErrUnauthorized is returned when the API of the source host refuses the credentials of the request, or
+	// they can't be obtained, like an expired token. It is also an ErrUpstream, so the caller sees it
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// UpstreamError is the ErrUpstream returned by providers, it holds the status of the response
+// or the error of the request when no response was received
+type UpstreamError struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %s", ErrUpstream, e.URL, e.Err)
+	}
+	return fmt.Sprintf("%s: %s responded with status %d", ErrUpstream, e.URL, e.StatusCode)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports the error as ErrUpstream when the request failed or the API responded with a server error,
+// and as both ErrUpstream and ErrUnauthorized when the API refused the credentials, so callers can check it
+// with errors.Is. Other responses, like a 404 for a missing repository, mean the source can't be validated
+// and are reported as ErrUncacheable
+func (e *UpstreamError) Is(target error) bool {
+	switch {
+	case e.Err != nil || e.StatusCode >= 500:
+		return target == ErrUpstream
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return target == ErrUpstream || target == ErrUnauthorized
+	}
+	return target == ErrUncacheable
+}
+
+// RateLimitError is the ErrRateLimited returned by providers, it holds the time the rate limit resets
+type RateLimitError struct {
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s until %s", ErrRateLimited, e.Reset.Format(time.RFC3339))
+}
+
+// Is reports the error as ErrRateLimited so callers can check it with errors.Is
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
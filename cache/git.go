@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// commitSha matches full and abbreviated commit shas, refs like these point to a single commit
+var commitSha = regexp.MustCompile("^[0-9a-f]{7,40}$")
+
+// GitProvider resolves the ref of the key to a commit sha with `git ls-remote`, so it works with
+// any remote the git command can reach: smart http, ssh and file urls. The sha is the revision
+type GitProvider struct {
+	command string
+}
+
+// NewGitProvider instantiates a provider that runs the git command found on PATH
+func NewGitProvider() *GitProvider {
+	return &GitProvider{command: "git"}
+}
+
+// Revision returns the sha of the commit the ref of the key points to, or of HEAD when the key has no ref.
+// Refs that look like commit shas are immutable and returned as is, refs missing on the remote are
+// reported with ErrUncacheable
+func (p *GitProvider) Revision(ctx context.Context, key Key, _ string) (string, error) {
+	if commitSha.MatchString(key.Ref) {
+		return key.Ref, nil
+	}
+	ref := key.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	source, err := ParseSource(key.Source)
+	if err != nil {
+		return "", err
+	}
+	remote := source.Remote()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.command, "ls-remote", remote, ref, ref+"^{}")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", &UpstreamError{URL: remote, Err: fmt.Errorf("error listing refs: %w: %s", err, strings.TrimSpace(stderr.String()))}
+	}
+	refs := map[string]string{}
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	for _, name := range []string{ref, "refs/heads/" + ref, "refs/tags/" + ref + "^{}", "refs/tags/" + ref} {
+		if sha, ok := refs[name]; ok {
+			return sha, nil
+		}
+	}
+	return "", fmt.Errorf("%w: ref %s not found on %s", ErrUncacheable, ref, remote)
+}
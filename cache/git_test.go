@@ -0,0 +1,97 @@
+package cache_test
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var _ = Describe("GitProvider", func() {
+	var dir string
+	var remote string
+	var head string
+	BeforeEach(func() {
+		if _, err := exec.LookPath("git"); err != nil {
+			Skip("git is not installed")
+		}
+		var err error
+		dir, err = ioutil.TempDir("", "git-provider")
+		assert.NoError(GinkgoT(), err)
+		bare := filepath.Join(dir, "repo.git")
+		work := filepath.Join(dir, "work")
+		remote = "git::file://" + bare
+		runGit(dir, "init", "--bare", bare)
+		runGit(dir, "init", work)
+		assert.NoError(GinkgoT(), ioutil.WriteFile(filepath.Join(work, "kustomization.yaml"), []byte("resources: []\n"), 0600))
+		runGit(work, "add", ".")
+		runGit(work, "commit", "-m", "first commit")
+		runGit(work, "tag", "-a", "v1", "-m", "first release")
+		runGit(work, "push", bare, "HEAD:refs/heads/main", "v1")
+		runGit(bare, "symbolic-ref", "HEAD", "refs/heads/main")
+		head = runGit(work, "rev-parse", "HEAD")
+	})
+	AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	Context("when the key has a branch ref", func() {
+		It("should return the sha of the branch", func() {
+			revision, err := cache.NewGitProvider().Revision(context.Background(), cache.NewKey(remote+"?ref=main", "", ""), "")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), head, revision)
+		})
+	})
+
+	Context("when the key has an annotated tag ref", func() {
+		It("should return the sha of the tagged commit", func() {
+			revision, err := cache.NewGitProvider().Revision(context.Background(), cache.NewKey(remote+"?ref=v1", "", ""), "")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), head, revision)
+		})
+	})
+
+	Context("when the key has no ref", func() {
+		It("should return the sha of HEAD", func() {
+			revision, err := cache.NewGitProvider().Revision(context.Background(), cache.NewKey(remote, "", ""), "")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), head, revision)
+		})
+	})
+
+	Context("when the key has an abbreviated sha ref", func() {
+		It("should return the ref without listing the remote", func() {
+			revision, err := cache.NewGitProvider().Revision(context.Background(), cache.NewKey("git::file://"+filepath.Join(dir, "missing.git")+"?ref="+head[:7], "", ""), "")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), head[:7], revision)
+		})
+	})
+
+	Context("when the ref does not exist", func() {
+		It("should return ErrUncacheable", func() {
+			_, err := cache.NewGitProvider().Revision(context.Background(), cache.NewKey(remote+"?ref=missing", "", ""), "")
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUncacheable)
+		})
+	})
+
+	Context("when the remote does not exist", func() {
+		It("should return error", func() {
+			_, err := cache.NewGitProvider().Revision(context.Background(), cache.NewKey("git::file://"+filepath.Join(dir, "missing.git"), "", ""), "")
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUpstream)
+		})
+	})
+})
+
+func runGit(dir string, args ...string) string {
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "init.defaultBranch=main"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	assert.NoError(GinkgoT(), err, string(output))
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	githubHost   = "github.com"
+	githubAPIURL = "https://api.github.com"
+)
+
+// GitHubProvider uses the etag of the GitHub repos API as revision, checking it with conditional requests
+// ( https://docs.github.com/en/rest/overview/resources-in-the-rest-api#conditional-requests).
+// Once the API reports the rate limit is exhausted the provider stops sending requests until it resets
+type GitHubProvider struct {
+	httpClient  HttpClient
+	baseURL     string
+	tokenSource oauth2.TokenSource
+	mu          sync.Mutex
+	reset       time.Time
+	// commits are the last commits listed by each commits API url and the etags of the responses,
+	// so the revisions of paths are checked with conditional requests too
+	commits map[string]listedCommit
+}
+
+type listedCommit struct {
+	etag string
+	sha  string
+}
+
+// NewGitHubProvider instantiates a provider for the GitHub API at baseURL, e.g. https://api.github.com.
+// Requests are authenticated with the tokens of tokenSource, or sent anonymously when it is nil
+func NewGitHubProvider(httpClient HttpClient, baseURL string, tokenSource oauth2.TokenSource) *GitHubProvider {
+	return &GitHubProvider{
+		httpClient:  httpClient,
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		tokenSource: tokenSource,
+		commits:     map[string]listedCommit{},
+	}
+}
+
+// Revision returns the validator when the repository is not modified or the new etag otherwise
+func (p *GitHubProvider) Revision(ctx context.Context, key Key, validator string) (string, error) {
+	source, err := ParseSource(key.Source)
+	if err != nil {
+		return "", err
+	}
+	apiUrl := fmt.Sprintf("%s/repos/%s/%s", p.baseURL, source.Owner, source.Repo)
+	headers := map[string]string{}
+	if validator != "" {
+		headers["If-None-Match"] = validator
+	}
+	response, err := p.get(ctx, apiUrl, headers)
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(response)
+	if response.StatusCode == http.StatusNotModified {
+		return validator, nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", &UpstreamError{URL: apiUrl, StatusCode: response.StatusCode}
+	}
+	return response.Header.Get("ETag"), nil
+}
+
+// PathRevision combines the shas of the last commits touching each path on the ref of the key,
+// fetched from the commits API ( https://docs.github.com/en/rest/commits/commits#list-commits )
+func (p *GitHubProvider) PathRevision(ctx context.Context, key Key, paths []string) (string, error) {
+	source, err := ParseSource(key.Source)
+	if err != nil {
+		return "", err
+	}
+	scoped := scopedPaths(key, paths)
+	revisions := make([]string, len(scoped))
+	for i, path := range scoped {
+		query := url.Values{"path": []string{path}, "per_page": []string{"1"}}
+		if key.Ref != "" {
+			query.Set("sha", key.Ref)
+		}
+		apiUrl := fmt.Sprintf("%s/repos/%s/%s/commits?%s", p.baseURL, source.Owner, source.Repo, query.Encode())
+		revisions[i], err = p.lastCommit(ctx, apiUrl)
+		if err != nil {
+			return "", err
+		}
+	}
+	return pathsRevision(scoped, revisions), nil
+}
+
+// lastCommit returns the sha of the first commit listed by the commits API url, empty when there are none.
+// The url is requested with the etag of its last response, a 304 returns the sha listed then
+func (p *GitHubProvider) lastCommit(ctx context.Context, apiUrl string) (string, error) {
+	p.mu.Lock()
+	listed, known := p.commits[apiUrl]
+	p.mu.Unlock()
+	headers := map[string]string{}
+	if known && listed.etag != "" {
+		headers["If-None-Match"] = listed.etag
+	}
+	response, err := p.get(ctx, apiUrl, headers)
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(response)
+	if response.StatusCode == http.StatusNotModified && known {
+		return listed.sha, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", &UpstreamError{URL: apiUrl, StatusCode: response.StatusCode}
+	}
+	var commits []struct {
+		SHA string `json:"sha"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&commits); err != nil {
+		return "", fmt.Errorf("%w: error decoding commits: %s", ErrUncacheable, err)
+	}
+	var sha string
+	if len(commits) > 0 {
+		sha = commits[0].SHA
+	}
+	p.mu.Lock()
+	p.commits[apiUrl] = listedCommit{etag: response.Header.Get("ETag"), sha: sha}
+	p.mu.Unlock()
+	return sha, nil
+}
+
+// get sends an authenticated request to the API unless the provider is rate limited
+func (p *GitHubProvider) get(ctx context.Context, apiUrl string, headers map[string]string) (*http.Response, error) {
+	if err := p.rateLimited(); err != nil {
+		return nil, err
+	}
+	if p.tokenSource != nil {
+		token, err := p.tokenSource.Token()
+		if err != nil {
+			return nil, &UpstreamError{URL: apiUrl, Err: fmt.Errorf("%w: error getting github token: %s", ErrUnauthorized, err)}
+		}
+		headers["Authorization"] = token.Type() + " " + token.AccessToken
+	}
+	response, err := doRequest(ctx, p.httpClient, apiUrl, headers)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.updateRateLimit(response); err != nil {
+		closeBody(response)
+		return nil, err
+	}
+	return response, nil
+}
+
+func (p *GitHubProvider) rateLimited() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().Before(p.reset) {
+		return &RateLimitError{Reset: p.reset}
+	}
+	return nil
+}
+
+// updateRateLimit records the reset time when the rate limit is exhausted, returning an error
+// when the response itself was refused because of the limit
+// ( https://docs.github.com/en/rest/overview/resources-in-the-rest-api#rate-limiting )
+func (p *GitHubProvider) updateRateLimit(response *http.Response) error {
+	var reset time.Time
+	if response.Header.Get("X-RateLimit-Remaining") == "0" {
+		seconds, err := strconv.ParseInt(response.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err == nil {
+			reset = time.Unix(seconds, 0)
+		}
+	}
+	refused := response.StatusCode == http.StatusForbidden || response.StatusCode == http.StatusTooManyRequests
+	if retryAfter := response.Header.Get("Retry-After"); refused && retryAfter != "" {
+		seconds, err := strconv.ParseInt(retryAfter, 10, 64)
+		if err == nil {
+			reset = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+	}
+	if reset.IsZero() {
+		return nil
+	}
+	p.mu.Lock()
+	p.reset = reset
+	p.mu.Unlock()
+	if refused {
+		return &RateLimitError{Reset: reset}
+	}
+	return nil
+}
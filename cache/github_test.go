@@ -0,0 +1,241 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"github.com/thallesfreitaszup/lib-kustomize/cache/mocks"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("GitHubProvider", func() {
+	var server *httptest.Server
+	var requests []*http.Request
+	var rateLimitHeaders map[string]string
+	var rateLimitStatus int
+	BeforeEach(func() {
+		requests = nil
+		rateLimitHeaders = map[string]string{}
+		rateLimitStatus = 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r)
+			for name, value := range rateLimitHeaders {
+				w.Header().Set(name, value)
+			}
+			if rateLimitStatus != 0 {
+				w.WriteHeader(rateLimitStatus)
+				return
+			}
+			if r.URL.Path == "/repos/org/repo/commits" {
+				if r.URL.Query().Get("path") == "unknown" {
+					_, _ = w.Write([]byte(`[]`))
+					return
+				}
+				etag := `"commits-` + r.URL.Query().Get("path") + `"`
+				if r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", etag)
+				_, _ = w.Write([]byte(`[{"sha":"sha-` + r.URL.Query().Get("path") + `"}]`))
+				return
+			}
+			if r.URL.Path != "/repos/org/repo" && r.URL.Path != "/api/v3/repos/org/repo" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Header.Get("If-None-Match") == `"etag-example"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"etag-example"`)
+			w.WriteHeader(http.StatusOK)
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("when the repository was never validated", func() {
+		It("should return the etag of the repository", func() {
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, nil)
+			revision, err := provider.Revision(context.Background(), cache.NewKey("git::https://github.com/org/repo.git", "", ""), "")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), `"etag-example"`, revision)
+			assert.Equal(GinkgoT(), "", requests[0].Header.Get("If-None-Match"))
+		})
+	})
+
+	Context("when the repository was not modified", func() {
+		It("should send a conditional request and return the same validator", func() {
+			provider := cache.NewGitHubProvider(server.Client(), server.URL+"/", nil)
+			revision, err := provider.Revision(context.Background(), cache.NewKey("github.com/org/repo", "", ""), `"etag-example"`)
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), `"etag-example"`, revision)
+			assert.Equal(GinkgoT(), `"etag-example"`, requests[0].Header.Get("If-None-Match"))
+		})
+	})
+
+	Context("when the repository was modified", func() {
+		It("should return the new etag", func() {
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, nil)
+			revision, err := provider.Revision(context.Background(), cache.NewKey("github.com/org/repo", "", ""), `"old-etag"`)
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), `"etag-example"`, revision)
+		})
+	})
+
+	Context("when the revision is scoped to paths", func() {
+		It("should combine the last commits touching each path", func() {
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, nil)
+			key := cache.NewKey("github.com/org/repo//deploy?ref=main", "overlays/dev", "")
+			revision, err := provider.PathRevision(context.Background(), key, []string{"overlays/dev", "base"})
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), 2, len(requests))
+			assert.Equal(GinkgoT(), "deploy/base", requests[0].URL.Query().Get("path"))
+			assert.Equal(GinkgoT(), "deploy/overlays/dev", requests[1].URL.Query().Get("path"))
+			assert.Equal(GinkgoT(), "main", requests[0].URL.Query().Get("sha"))
+
+			reordered, err := provider.PathRevision(context.Background(), key, []string{"base", "overlays/dev"})
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), revision, reordered)
+			other, err := provider.PathRevision(context.Background(), key, []string{"base", "unknown"})
+			assert.NoError(GinkgoT(), err)
+			assert.NotEqual(GinkgoT(), revision, other)
+		})
+	})
+
+	Context("when the revision of the paths is checked again", func() {
+		It("should send conditional requests with the etag of each path", func() {
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, nil)
+			key := cache.NewKey("github.com/org/repo?ref=main", "overlays/dev", "")
+			revision, err := provider.PathRevision(context.Background(), key, []string{"overlays/dev", "base"})
+			assert.NoError(GinkgoT(), err)
+			again, err := provider.PathRevision(context.Background(), key, []string{"overlays/dev", "base"})
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), revision, again)
+			assert.Equal(GinkgoT(), 4, len(requests))
+			assert.Equal(GinkgoT(), `"commits-base"`, requests[2].Header.Get("If-None-Match"))
+			assert.Equal(GinkgoT(), `"commits-overlays/dev"`, requests[3].Header.Get("If-None-Match"))
+		})
+	})
+
+	Context("when the provider has a token source", func() {
+		It("should authenticate the requests", func() {
+			tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret"})
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, tokenSource)
+			_, err := provider.Revision(context.Background(), cache.NewKey("github.com/org/repo", "", ""), "")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), "Bearer secret", requests[0].Header.Get("Authorization"))
+		})
+	})
+
+	Context("when the token of the provider can't be obtained", func() {
+		It("should return an unauthorized upstream error without sending the request", func() {
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, failingTokenSource{})
+			_, err := provider.Revision(context.Background(), cache.NewKey("github.com/org/repo", "", ""), "")
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUnauthorized)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUpstream)
+			assert.Empty(GinkgoT(), requests)
+		})
+	})
+
+	Context("when the rate limit is exhausted", func() {
+		It("should stop sending requests until the limit resets", func() {
+			reset := time.Now().Add(time.Hour).Truncate(time.Second)
+			rateLimitHeaders["X-RateLimit-Remaining"] = "0"
+			rateLimitHeaders["X-RateLimit-Reset"] = strconv.FormatInt(reset.Unix(), 10)
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, nil)
+			key := cache.NewKey("github.com/org/repo", "", "")
+			revision, err := provider.Revision(context.Background(), key, "")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), `"etag-example"`, revision)
+
+			_, err = provider.Revision(context.Background(), key, revision)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrRateLimited)
+			var rateLimitError *cache.RateLimitError
+			assert.True(GinkgoT(), errors.As(err, &rateLimitError))
+			assert.True(GinkgoT(), reset.Equal(rateLimitError.Reset))
+			assert.Equal(GinkgoT(), 1, len(requests))
+		})
+	})
+
+	Context("when the request is refused because of the rate limit", func() {
+		It("should return ErrRateLimited", func() {
+			rateLimitHeaders["X-RateLimit-Remaining"] = "0"
+			rateLimitHeaders["X-RateLimit-Reset"] = strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+			rateLimitStatus = http.StatusForbidden
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, nil)
+			_, err := provider.Revision(context.Background(), cache.NewKey("github.com/org/repo", "", ""), "")
+			assert.ErrorIs(GinkgoT(), err, cache.ErrRateLimited)
+		})
+	})
+
+	Context("when the request is refused with a retry after header", func() {
+		It("should return ErrRateLimited until the retry time", func() {
+			rateLimitHeaders["Retry-After"] = "60"
+			rateLimitStatus = http.StatusTooManyRequests
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, nil)
+			key := cache.NewKey("github.com/org/repo", "", "")
+			_, err := provider.Revision(context.Background(), key, "")
+			assert.ErrorIs(GinkgoT(), err, cache.ErrRateLimited)
+			_, err = provider.Revision(context.Background(), key, "")
+			assert.ErrorIs(GinkgoT(), err, cache.ErrRateLimited)
+			assert.Equal(GinkgoT(), 1, len(requests))
+		})
+	})
+
+	Context("when the rate limit reset is in the past", func() {
+		It("should keep sending requests", func() {
+			rateLimitHeaders["X-RateLimit-Remaining"] = "0"
+			rateLimitHeaders["X-RateLimit-Reset"] = strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+			provider := cache.NewGitHubProvider(server.Client(), server.URL, nil)
+			key := cache.NewKey("github.com/org/repo", "", "")
+			_, err := provider.Revision(context.Background(), key, "")
+			assert.NoError(GinkgoT(), err)
+			_, err = provider.Revision(context.Background(), key, "")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), 2, len(requests))
+		})
+	})
+
+	Context("when the wrapper has a custom GitHub API url", func() {
+		It("should check github.com sources on it", func() {
+			mockCache := new(mocks.Cache)
+			key := cache.NewKey("github.com/org/repo", "overlays/dev", "")
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: `"etag-example"`, Manifests: getManifestsCached()}, true)
+			wrapper := cache.New(mockCache, server.Client(), cache.WithGitHubBaseURL(server.URL))
+			manifests, err := wrapper.GetManifests(key)
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), 1, len(manifests))
+			assert.Equal(GinkgoT(), 1, len(requests))
+		})
+	})
+
+	Context("when the source is hosted on GitHub Enterprise", func() {
+		It("should check it on the API of the enterprise host", func() {
+			mockCache := new(mocks.Cache)
+			key := cache.NewKey("git::https://github.example.com/org/repo.git", "overlays/dev", "")
+			mockCache.On("Get", key.String()).Return(cache.Entry{Revision: `"old-etag"`, Manifests: getManifestsCached()}, true)
+			mockCache.On("Set", key.String(), cache.Entry{Revision: `"etag-example"`}, cache.EntryCost(cache.Entry{Revision: `"etag-example"`})).Return(true)
+			wrapper := cache.New(mockCache, server.Client(), cache.WithGitHubEnterprise("github.example.com", server.URL+"/api/v3"))
+			_, err := wrapper.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrModified)
+			assert.Equal(GinkgoT(), 1, len(requests))
+			assert.Equal(GinkgoT(), "/api/v3/repos/org/repo", requests[0].URL.Path)
+		})
+	})
+})
+
+// failingTokenSource fails to get a token, like one whose refresh token expired
+type failingTokenSource struct{}
+
+func (failingTokenSource) Token() (*oauth2.Token, error) {
+	return nil, errors.New("refresh token expired")
+}
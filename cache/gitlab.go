@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	gitlabHost   = "gitlab.com"
+	gitlabAPIURL = "https://gitlab.com/api/v4"
+)
+
+// GitLabProvider uses the sha of the last commit on the ref of the key as revision, fetched from the
+// GitLab commits API ( https://docs.gitlab.com/ee/api/commits.html#list-repository-commits )
+type GitLabProvider struct {
+	httpClient HttpClient
+	baseURL    string
+}
+
+// NewGitLabProvider instantiates a provider for the GitLab API at baseURL, e.g. https://gitlab.com/api/v4
+func NewGitLabProvider(httpClient HttpClient, baseURL string) *GitLabProvider {
+	return &GitLabProvider{
+		httpClient: httpClient,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Revision returns the sha of the last commit of the ref, or of the default branch when the key has no ref
+func (p *GitLabProvider) Revision(ctx context.Context, key Key, _ string) (string, error) {
+	sha, err := p.lastCommit(ctx, key, "")
+	if err != nil {
+		return "", err
+	}
+	if sha == "" {
+		return "", fmt.Errorf("%w: project has no commits", ErrUncacheable)
+	}
+	return sha, nil
+}
+
+// PathRevision combines the shas of the last commits touching each path on the ref of the key
+func (p *GitLabProvider) PathRevision(ctx context.Context, key Key, paths []string) (string, error) {
+	scoped := scopedPaths(key, paths)
+	revisions := make([]string, len(scoped))
+	for i, path := range scoped {
+		sha, err := p.lastCommit(ctx, key, path)
+		if err != nil {
+			return "", err
+		}
+		revisions[i] = sha
+	}
+	return pathsRevision(scoped, revisions), nil
+}
+
+// lastCommit returns the sha of the last commit of the ref of the key touching path, or of any path when it is empty.
+// It is empty when there are no such commits
+func (p *GitLabProvider) lastCommit(ctx context.Context, key Key, path string) (string, error) {
+	source, err := ParseSource(key.Source)
+	if err != nil {
+		return "", err
+	}
+	project := source.Owner + "/" + source.Repo
+	query := url.Values{"per_page": []string{"1"}}
+	if key.Ref != "" {
+		query.Set("ref_name", key.Ref)
+	}
+	if path != "" {
+		query.Set("path", path)
+	}
+	apiUrl := fmt.Sprintf("%s/projects/%s/repository/commits?%s", p.baseURL, url.PathEscape(project), query.Encode())
+	response, err := doRequest(ctx, p.httpClient, apiUrl, map[string]string{})
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(response)
+	if response.StatusCode != http.StatusOK {
+		return "", &UpstreamError{URL: apiUrl, StatusCode: response.StatusCode}
+	}
+	var commits []struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&commits); err != nil {
+		return "", fmt.Errorf("%w: error decoding commits of project %s: %s", ErrUncacheable, project, err)
+	}
+	if len(commits) == 0 {
+		return "", nil
+	}
+	return commits[0].ID, nil
+}
@@ -0,0 +1,79 @@
+package cache_test
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("GitLabProvider", func() {
+	var server *httptest.Server
+	var requests []*http.Request
+	BeforeEach(func() {
+		requests = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r)
+			if r.URL.EscapedPath() != "/projects/group%2Fsubgroup%2Frepo/repository/commits" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.URL.Query().Get("ref_name") == "empty" {
+				_, _ = w.Write([]byte(`[]`))
+				return
+			}
+			if path := r.URL.Query().Get("path"); path != "" {
+				_, _ = w.Write([]byte(`[{"id":"sha-` + path + `"}]`))
+				return
+			}
+			_, _ = w.Write([]byte(`[{"id":"6104942438c14ec7bd21c6cd5bd995272b3faff6"}]`))
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("when the project has commits on the ref", func() {
+		It("should return the sha of the last commit", func() {
+			provider := cache.NewGitLabProvider(server.Client(), server.URL)
+			key := cache.NewKey("git::git@gitlab.com:group/subgroup/repo.git//sub?ref=main", "overlays/dev", "")
+			revision, err := provider.Revision(context.Background(), key, "")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), "6104942438c14ec7bd21c6cd5bd995272b3faff6", revision)
+			assert.Equal(GinkgoT(), "main", requests[0].URL.Query().Get("ref_name"))
+			assert.Equal(GinkgoT(), "1", requests[0].URL.Query().Get("per_page"))
+		})
+	})
+
+	Context("when the revision is scoped to paths", func() {
+		It("should combine the last commits touching each path on the ref", func() {
+			provider := cache.NewGitLabProvider(server.Client(), server.URL)
+			key := cache.NewKey("git::git@gitlab.com:group/subgroup/repo.git//sub?ref=main", "overlays/dev", "")
+			revision, err := provider.PathRevision(context.Background(), key, []string{"overlays/dev", "base"})
+			assert.NoError(GinkgoT(), err)
+			assert.NotEmpty(GinkgoT(), revision)
+			assert.Equal(GinkgoT(), 2, len(requests))
+			assert.Equal(GinkgoT(), "sub/base", requests[0].URL.Query().Get("path"))
+			assert.Equal(GinkgoT(), "sub/overlays/dev", requests[1].URL.Query().Get("path"))
+			assert.Equal(GinkgoT(), "main", requests[1].URL.Query().Get("ref_name"))
+		})
+	})
+
+	Context("when the project does not exist", func() {
+		It("should return ErrUncacheable", func() {
+			provider := cache.NewGitLabProvider(server.Client(), server.URL)
+			_, err := provider.Revision(context.Background(), cache.NewKey("gitlab.com/group/other", "", ""), "")
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUncacheable)
+		})
+	})
+
+	Context("when the ref has no commits", func() {
+		It("should return error", func() {
+			provider := cache.NewGitLabProvider(server.Client(), server.URL)
+			_, err := provider.Revision(context.Background(), cache.NewKey("gitlab.com/group/subgroup/repo?ref=empty", "", ""), "")
+			assert.Error(GinkgoT(), err)
+		})
+	})
+})
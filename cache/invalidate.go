@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+)
+
+// Invalidate removes the entry of the key, the next lookup fetches the revision again and the manifests are rendered again.
+// Lookups of the key in flight don't set their entry back
+func (w Wrapper) Invalidate(key Key) {
+	w.del(key.Source, key)
+	w.wait()
+}
+
+// InvalidateSource removes the entries of every path, ref and option of the repository of the source,
+// e.g. after a branch was force pushed. The Cache can't list its keys, so only the keys looked up
+// by the wrapper since it was instantiated are removed
+func (w Wrapper) InvalidateSource(source string) error {
+	s, err := ParseSource(source)
+	if err != nil {
+		return err
+	}
+	repository := s.Repository()
+	for _, key := range w.keys.list(repository) {
+		w.del(repository, key)
+	}
+	w.wait()
+	return nil
+}
+
+// Purge removes every entry of the cache. Caches that don't implement Clearer only have the keys looked up
+// by the wrapper since it was instantiated removed
+func (w Wrapper) Purge() {
+	w.keys.clear(func(keys []Key) {
+		if clearer, ok := w.cache.(Clearer); ok {
+			clearer.Clear()
+			return
+		}
+		for _, key := range keys {
+			w.cache.Del(key.String())
+		}
+	})
+	w.metrics.cleared()
+	w.wait()
+}
+
+// InvalidatePush removes the entries of the keys a push of ref to a repository changes, returning them.
+// The repository is given by its host and path, e.g. github.com and org/repo, and ref is the pushed
+// ref, e.g. refs/heads/main or refs/tags/v1. Keys without ref follow the default branch of the repository.
+// Like InvalidateSource, only the keys looked up by this wrapper are known, so on a shared Cache the keys
+// looked up only by other replicas are left to be detected by their revision checks
+func (w Wrapper) InvalidatePush(host, path, ref, defaultBranch string) []Key {
+	name := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	isDefault := strings.HasPrefix(ref, "refs/heads/") && name == defaultBranch
+	var invalidated []Key
+	for _, key := range w.keys.list("") {
+		if !sameRepository(key, host, path) {
+			continue
+		}
+		if key.Ref != name && key.Ref != ref && !(key.Ref == "" && isDefault) {
+			continue
+		}
+		w.del(key.Source, key)
+		invalidated = append(invalidated, key)
+	}
+	w.wait()
+	return invalidated
+}
+
+// sameRepository reports if the source of the key is the repository at host and path, ignoring the scheme,
+// the port and the .git suffix
+func sameRepository(key Key, host, path string) bool {
+	source, err := ParseSource(key.Source)
+	if err != nil {
+		return false
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return strings.EqualFold(hostname(source.Host), hostname(host)) &&
+		strings.EqualFold(source.Owner+"/"+source.Repo, path)
+}
+
+func hostname(host string) string {
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
+
+// del removes the entry of the key, tracked under repository, from cache
+func (w Wrapper) del(repository string, key Key) {
+	w.keys.remove(repository, key.String(), func() {
+		w.cache.Del(key.String())
+	})
+	w.metrics.deleted(key.String())
+}
+
+func (w Wrapper) wait() {
+	if waiter, ok := w.cache.(Waiter); ok {
+		waiter.Wait()
+	}
+}
+
+// keyIndex tracks the keys looked up by the wrapper for each repository, so the keys of a source
+// can be invalidated
+type keyIndex struct {
+	mu   sync.Mutex
+	keys map[string]map[string]Key
+	// generation counts the invalidations, deleted holds the generation each key was last deleted at and
+	// cleared the one the cache was last cleared at, so the lookups started before don't set their entries back
+	generation uint64
+	deleted    map[string]uint64
+	cleared    uint64
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{keys: map[string]map[string]Key{}, deleted: map[string]uint64{}}
+}
+
+// add tracks the key, returning the generation its lookup starts at
+func (i *keyIndex) add(key Key) uint64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	keys, ok := i.keys[key.Source]
+	if !ok {
+		keys = map[string]Key{}
+		i.keys[key.Source] = keys
+	}
+	keys[key.String()] = key
+	return i.generation
+}
+
+// remove stops tracking the key and deletes its entry with del, the lookups started before can't set it back
+func (i *keyIndex) remove(repository, key string, del func()) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.generation++
+	i.deleted[key] = i.generation
+	del()
+	delete(i.keys[repository], key)
+	if len(i.keys[repository]) == 0 {
+		delete(i.keys, repository)
+	}
+}
+
+// ifCurrent calls set unless the key was deleted or the cache cleared after generation
+func (i *keyIndex) ifCurrent(key string, generation uint64, set func()) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.deleted[key] > generation || i.cleared > generation {
+		return
+	}
+	set()
+}
+
+// list returns the keys of the repository, or of every repository when it is empty
+func (i *keyIndex) list(repository string) []Key {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var list []Key
+	for source, keys := range i.keys {
+		if repository != "" && source != repository {
+			continue
+		}
+		for _, key := range keys {
+			list = append(list, key)
+		}
+	}
+	return list
+}
+
+// clear stops tracking every key and clears the cache with del, given the keys tracked
+func (i *keyIndex) clear(del func(keys []Key)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var keys []Key
+	for _, repositoryKeys := range i.keys {
+		for _, key := range repositoryKeys {
+			keys = append(keys, key)
+		}
+	}
+	del(keys)
+	i.generation++
+	i.cleared = i.generation
+	// the deletions before the clear are covered by it
+	i.deleted = map[string]uint64{}
+	i.keys = map[string]map[string]Key{}
+}
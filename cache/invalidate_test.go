@@ -0,0 +1,119 @@
+package cache_test
+
+import (
+	"github.com/dgraph-io/ristretto"
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"github.com/thallesfreitaszup/lib-kustomize/cache/mocks"
+	"time"
+)
+
+var _ = Describe("Invalidation", func() {
+	var ristrettoCache *ristretto.Cache
+	var manifestCache cache.Wrapper
+	var dev cache.Key
+	var prod cache.Key
+	var other cache.Key
+	BeforeEach(func() {
+		var err error
+		ristrettoCache, err = ristretto.NewCache(&ristretto.Config{
+			NumCounters: 1e4,
+			MaxCost:     1 << 20,
+			BufferItems: 64,
+		})
+		assert.NoError(GinkgoT(), err)
+		provider := new(mocks.RevisionProvider)
+		provider.On("Revision", mock.Anything, mock.Anything, mock.Anything).Return("etag", nil)
+		manifestCache = cache.New(ristrettoCache, new(mocks.HttpClient), cache.WithDefaultRevisionProvider(provider))
+		dev = cache.NewKey("example.com/org/source?ref=main", "overlays/dev", "")
+		prod = cache.NewKey("example.com/org/source", "overlays/prod", "")
+		other = cache.NewKey("example.com/org/other", "overlays/dev", "")
+		for _, key := range []cache.Key{dev, prod, other} {
+			_, err := manifestCache.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+			assert.NoError(GinkgoT(), manifestCache.Add(key, getManifestsCached()))
+		}
+	})
+	AfterEach(func() {
+		ristrettoCache.Close()
+	})
+
+	Context("when a key is invalidated", func() {
+		It("should render only that key again", func() {
+			manifestCache.Invalidate(dev)
+			_, err := manifestCache.GetManifests(dev)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+			manifests, err := manifestCache.GetManifests(prod)
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), 1, len(manifests))
+		})
+	})
+
+	Context("when a key is invalidated while it is looked up", func() {
+		It("should not set the entry of the lookup back", func() {
+			started, release := make(chan struct{}), make(chan struct{})
+			provider := new(mocks.RevisionProvider)
+			provider.On("Revision", mock.Anything, dev, "etag").Return("etag", nil).Run(func(mock.Arguments) {
+				close(started)
+				<-release
+			}).Once()
+			provider.On("Revision", mock.Anything, dev, "").Return("etag", nil)
+			validatingCache := cache.New(ristrettoCache, new(mocks.HttpClient), cache.WithDefaultRevisionProvider(provider),
+				cache.WithMaxAge(time.Nanosecond))
+			lookedUp := make(chan error, 1)
+			go func() {
+				_, err := validatingCache.GetManifests(dev)
+				lookedUp <- err
+			}()
+			<-started
+			validatingCache.Invalidate(dev)
+			close(release)
+			assert.NoError(GinkgoT(), <-lookedUp)
+
+			_, err := validatingCache.GetManifests(dev)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+		})
+	})
+
+	Context("when a source is invalidated", func() {
+		It("should render every path and ref of the repository again", func() {
+			assert.NoError(GinkgoT(), manifestCache.InvalidateSource("example.com/org/source//sub?ref=other"))
+			_, err := manifestCache.GetManifests(dev)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+			_, err = manifestCache.GetManifests(prod)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+			manifests, err := manifestCache.GetManifests(other)
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), 1, len(manifests))
+		})
+
+		It("should return error when the source is invalid", func() {
+			assert.ErrorIs(GinkgoT(), manifestCache.InvalidateSource("./manifests"), cache.ErrInvalidSource)
+		})
+	})
+
+	Context("when the cache is purged", func() {
+		It("should render every key again", func() {
+			manifestCache.Purge()
+			for _, key := range []cache.Key{dev, prod, other} {
+				_, err := manifestCache.GetManifests(key)
+				assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+			}
+		})
+
+		It("should delete the known keys when the cache can't be cleared", func() {
+			mockCache := new(mocks.Cache)
+			provider := new(mocks.RevisionProvider)
+			mockCache.On("Get", dev.String()).Return(cache.Entry{Revision: "etag", Manifests: getManifestsCached()}, true)
+			provider.On("Revision", mock.Anything, dev, "etag").Return("etag", nil)
+			mockCache.On("Del", dev.String()).Times(1)
+			wrapper := cache.New(mockCache, new(mocks.HttpClient), cache.WithDefaultRevisionProvider(provider))
+			_, err := wrapper.GetManifests(dev)
+			assert.NoError(GinkgoT(), err)
+			wrapper.Purge()
+			mockCache.AssertExpectations(GinkgoT())
+		})
+	})
+})
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/go-getter"
+)
+
+// Key identifies the manifests rendered from a source on cache, renders of the same repository
+// with a different ref, subdirectory, path or renderer options never share an entry
+type Key struct {
+	// Source is the repository url without the subdirectory and the query options
+	Source string
+	// Ref is the branch, tag or commit of the source, empty means the default branch
+	Ref string
+	// Subdir is the subdirectory of the source selected with the go-getter `//` syntax
+	Subdir string
+	// Path is the kustomization root inside the downloaded source
+	Path string
+	// Options is a fingerprint of the options used by the renderer
+	Options string
+}
+
+// NewKey builds the key of the manifests rendered from the go-getter source on the given path.
+// The options argument is a fingerprint of the renderer options and may be empty.
+// The source is stored in its canonical form, sources that can't be parsed are kept as given
+// and fail to be validated on cache lookups
+func NewKey(source, path, options string) Key {
+	if s, err := ParseSource(source); err == nil {
+		return Key{
+			Source:  s.Repository(),
+			Ref:     s.Ref,
+			Subdir:  s.Subdir,
+			Path:    strings.Trim(path, "/"),
+			Options: options,
+		}
+	}
+	src, subdir := getter.SourceDirSubdir(source)
+	var ref string
+	if i := strings.Index(src, "?"); i >= 0 {
+		query, err := url.ParseQuery(src[i+1:])
+		if err == nil {
+			ref = query.Get("ref")
+		}
+		src = src[:i]
+	}
+	return Key{
+		Source:  src,
+		Ref:     ref,
+		Subdir:  strings.Trim(subdir, "/"),
+		Path:    strings.Trim(path, "/"),
+		Options: options,
+	}
+}
+
+// String returns the representation of the key used to store entries on cache
+func (k Key) String() string {
+	values := url.Values{}
+	for name, value := range map[string]string{
+		"ref":     k.Ref,
+		"subdir":  k.Subdir,
+		"path":    k.Path,
+		"options": k.Options,
+	} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	if len(values) == 0 {
+		return k.Source
+	}
+	return k.Source + "?" + values.Encode()
+}
@@ -0,0 +1,54 @@
+package cache_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+)
+
+var _ = Describe("Key", func() {
+	Context("when the source has a subdirectory and a ref", func() {
+		It("should split them from the source", func() {
+			key := cache.NewKey("git::git@gitlab.com:org/repo.git//sub?ref=main", "overlays/dev/", "")
+			assert.Equal(GinkgoT(), "git::ssh://git@gitlab.com/org/repo.git", key.Source)
+			assert.Equal(GinkgoT(), "main", key.Ref)
+			assert.Equal(GinkgoT(), "sub", key.Subdir)
+			assert.Equal(GinkgoT(), "overlays/dev", key.Path)
+			assert.Equal(GinkgoT(), "git::ssh://git@gitlab.com/org/repo.git?path=overlays%2Fdev&ref=main&subdir=sub", key.String())
+		})
+	})
+
+	Context("when the source has no subdirectory, ref or path", func() {
+		It("should use the source as key", func() {
+			key := cache.NewKey("github.com/org/repo", "", "")
+			assert.Equal(GinkgoT(), "github.com/org/repo", key.String())
+		})
+	})
+
+	Context("when the source can't be parsed", func() {
+		It("should keep the source as given", func() {
+			key := cache.NewKey("./manifests//sub?ref=main", "overlays/dev", "")
+			assert.Equal(GinkgoT(), "./manifests", key.Source)
+			assert.Equal(GinkgoT(), "main", key.Ref)
+			assert.Equal(GinkgoT(), "sub", key.Subdir)
+		})
+	})
+
+	Context("when two keys differ only on path", func() {
+		It("should not share the cache entry", func() {
+			dev := cache.NewKey("github.com/org/repo", "overlays/dev", "")
+			prod := cache.NewKey("github.com/org/repo", "overlays/prod", "")
+			assert.NotEqual(GinkgoT(), dev.String(), prod.String())
+		})
+	})
+
+	Context("when two keys differ only on ref or options", func() {
+		It("should not share the cache entry", func() {
+			main := cache.NewKey("github.com/org/repo?ref=main", "overlays/dev", "")
+			tag := cache.NewKey("github.com/org/repo?ref=v1", "overlays/dev", "")
+			withOptions := cache.NewKey("github.com/org/repo?ref=main", "overlays/dev", "abc")
+			assert.NotEqual(GinkgoT(), main.String(), tag.String())
+			assert.NotEqual(GinkgoT(), main.String(), withOptions.String())
+		})
+	})
+})
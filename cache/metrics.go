@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"errors"
+	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/z"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts the lookups and revision checks of a Wrapper and tracks the entries it stores.
+// It can be shared with the eviction callbacks of the cache, e.g. with ristretto, so evictions are subtracted
+// from the bytes stored. Other caches don't report evictions, see Stats.BytesStored:
+//
+//	metrics := cache.NewMetrics()
+//	ristretto.NewCache(&ristretto.Config{OnEvict: metrics.OnEvict, OnReject: metrics.OnReject, ...})
+//	cache.New(ristrettoCache, httpClient, cache.WithMetrics(metrics))
+type Metrics struct {
+	// the uint64 counters must stay 64-bit aligned for sync/atomic on 386 and arm, which only holds for the
+	// leading fields of an allocated struct
+	hits           uint64
+	misses         uint64
+	revisionChecks uint64
+	notModified    uint64
+	upstreamErrors uint64
+	rateLimited    uint64
+	evictions      uint64
+	mu             sync.Mutex
+	bytes          int64
+	// costs are the costs of the entries on cache by the ristretto hash of their key, so evictions can be subtracted
+	costs   map[uint64]int64
+	sources map[string]SourceStats
+}
+
+// Stats is a snapshot of the Metrics of a Wrapper
+type Stats struct {
+	// Hits are the lookups that returned manifests, stale ones included, Misses the ones that didn't
+	Hits   uint64
+	Misses uint64
+	// RevisionChecks are the revisions fetched from the providers, NotModified the lookups that found the
+	// source unchanged, like GitHub 304 responses, UpstreamErrors the checks that failed with ErrUpstream
+	// and RateLimited the ones refused with ErrRateLimited
+	RevisionChecks uint64
+	NotModified    uint64
+	UpstreamErrors uint64
+	RateLimited    uint64
+	// Evictions are the entries the cache evicted, they are only counted when its eviction callback calls OnEvict
+	Evictions uint64
+	// BytesStored is the cost of the entries the wrapper stored, their size in bytes unless the wrapper has a cost function.
+	// It is only exact for caches whose evictions call OnEvict and OnReject, like ristretto: entries evicted by a
+	// DiskCache or expired by Redis are still counted until the wrapper deletes or replaces them
+	BytesStored int64
+	// Sources are the last validation and render times of each source
+	Sources map[string]SourceStats
+}
+
+// SourceStats are the last validation and render times of the manifests of a source
+type SourceStats struct {
+	LastValidated time.Time
+	LastRendered  time.Time
+}
+
+// HitRatio returns the share of lookups that returned manifests, zero when there were none
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// NewMetrics instantiates empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{costs: map[uint64]int64{}, sources: map[string]SourceStats{}}
+}
+
+// Stats returns a snapshot of the metrics
+func (m *Metrics) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sources := make(map[string]SourceStats, len(m.sources))
+	for source, stats := range m.sources {
+		sources[source] = stats
+	}
+	return Stats{
+		Hits:           atomic.LoadUint64(&m.hits),
+		Misses:         atomic.LoadUint64(&m.misses),
+		RevisionChecks: atomic.LoadUint64(&m.revisionChecks),
+		NotModified:    atomic.LoadUint64(&m.notModified),
+		UpstreamErrors: atomic.LoadUint64(&m.upstreamErrors),
+		RateLimited:    atomic.LoadUint64(&m.rateLimited),
+		Evictions:      atomic.LoadUint64(&m.evictions),
+		BytesStored:    m.bytes,
+		Sources:        sources,
+	}
+}
+
+// OnEvict counts an entry evicted by a ristretto cache and removes its cost from the bytes stored
+func (m *Metrics) OnEvict(item *ristretto.Item) {
+	atomic.AddUint64(&m.evictions, 1)
+	m.OnReject(item)
+}
+
+// OnReject removes the cost of an entry a ristretto cache refused to store from the bytes stored
+func (m *Metrics) OnReject(item *ristretto.Item) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes -= m.costs[item.Key]
+	delete(m.costs, item.Key)
+}
+
+func (m *Metrics) lookedUp(err error) {
+	if err == nil {
+		atomic.AddUint64(&m.hits, 1)
+		return
+	}
+	atomic.AddUint64(&m.misses, 1)
+}
+
+func (m *Metrics) revisionChecked(err error) {
+	atomic.AddUint64(&m.revisionChecks, 1)
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		atomic.AddUint64(&m.rateLimited, 1)
+	case errors.Is(err, ErrUpstream):
+		atomic.AddUint64(&m.upstreamErrors, 1)
+	}
+}
+
+func (m *Metrics) notModifiedFound() {
+	atomic.AddUint64(&m.notModified, 1)
+}
+
+func (m *Metrics) validated(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.sources[source]
+	stats.LastValidated = time.Now()
+	m.sources[source] = stats
+}
+
+func (m *Metrics) rendered(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.sources[source]
+	stats.LastRendered = time.Now()
+	m.sources[source] = stats
+}
+
+// stored records the cost of an entry set under key, returning the cost recorded before so it can be restored
+// when the cache doesn't set the entry
+func (m *Metrics) stored(key string, cost int64) (int64, bool) {
+	hash, _ := z.KeyToHash(key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	previous, existed := m.costs[hash]
+	m.bytes += cost - previous
+	m.costs[hash] = cost
+	return previous, existed
+}
+
+// unstored restores the cost recorded for key before a set the cache didn't apply, unless the cost changed
+// since, like when the cache evicted the entry meanwhile
+func (m *Metrics) unstored(key string, cost, previous int64, existed bool) {
+	hash, _ := z.KeyToHash(key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if current, ok := m.costs[hash]; !ok || current != cost {
+		return
+	}
+	m.bytes += previous - cost
+	if existed {
+		m.costs[hash] = previous
+	} else {
+		delete(m.costs, hash)
+	}
+}
+
+func (m *Metrics) deleted(key string) {
+	hash, _ := z.KeyToHash(key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes -= m.costs[hash]
+	delete(m.costs, hash)
+}
+
+func (m *Metrics) cleared() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes = 0
+	m.costs = map[uint64]int64{}
+}
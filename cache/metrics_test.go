@@ -0,0 +1,134 @@
+package cache_test
+
+import (
+	"context"
+	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/z"
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"github.com/thallesfreitaszup/lib-kustomize/cache/mocks"
+)
+
+var _ = Describe("Metrics", func() {
+	var ristrettoCache *ristretto.Cache
+	var metrics *cache.Metrics
+	var provider *mocks.RevisionProvider
+	var manifestCache cache.Wrapper
+	var key cache.Key
+	BeforeEach(func() {
+		var err error
+		metrics = cache.NewMetrics()
+		ristrettoCache, err = ristretto.NewCache(&ristretto.Config{
+			NumCounters: 1e4,
+			MaxCost:     1 << 20,
+			BufferItems: 64,
+			OnEvict:     metrics.OnEvict,
+			OnReject:    metrics.OnReject,
+		})
+		assert.NoError(GinkgoT(), err)
+		provider = new(mocks.RevisionProvider)
+		manifestCache = cache.New(ristrettoCache, new(mocks.HttpClient), cache.WithDefaultRevisionProvider(provider), cache.WithMetrics(metrics))
+		key = cache.NewKey("example.com/org/source", "overlays/dev", "")
+	})
+	AfterEach(func() {
+		ristrettoCache.Close()
+	})
+
+	Context("when manifests are looked up", func() {
+		It("should count the hits, misses and revision checks", func() {
+			provider.On("Revision", mock.Anything, key, "").Return("etag", nil).Once()
+			provider.On("Revision", mock.Anything, key, "etag").Return("etag", nil)
+			_, err := manifestCache.Lookup(context.Background(), key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+			assert.NoError(GinkgoT(), manifestCache.Add(key, getManifestsCached()))
+			_, err = manifestCache.Lookup(context.Background(), key)
+			assert.NoError(GinkgoT(), err)
+
+			stats := manifestCache.Stats()
+			assert.Equal(GinkgoT(), uint64(1), stats.Hits)
+			assert.Equal(GinkgoT(), uint64(1), stats.Misses)
+			assert.Equal(GinkgoT(), 0.5, stats.HitRatio())
+			assert.Equal(GinkgoT(), uint64(2), stats.RevisionChecks)
+			assert.Equal(GinkgoT(), uint64(1), stats.NotModified)
+			assert.False(GinkgoT(), stats.Sources[key.Source].LastValidated.IsZero())
+			assert.False(GinkgoT(), stats.Sources[key.Source].LastRendered.IsZero())
+		})
+
+		It("should count the failed revision checks", func() {
+			provider.On("Revision", mock.Anything, key, "").Return("", &cache.UpstreamError{URL: "https://example.com", StatusCode: 500}).Once()
+			provider.On("Revision", mock.Anything, key, "").Return("", cache.ErrRateLimited)
+			_, err := manifestCache.Lookup(context.Background(), key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrUpstream)
+			_, err = manifestCache.Lookup(context.Background(), key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrRateLimited)
+
+			stats := manifestCache.Stats()
+			assert.Equal(GinkgoT(), uint64(2), stats.Misses)
+			assert.Equal(GinkgoT(), uint64(1), stats.UpstreamErrors)
+			assert.Equal(GinkgoT(), uint64(1), stats.RateLimited)
+			assert.True(GinkgoT(), stats.Sources[key.Source].LastValidated.IsZero())
+		})
+	})
+
+	Context("when entries are stored and removed", func() {
+		It("should track the bytes stored", func() {
+			provider.On("Revision", mock.Anything, key, "").Return("etag", nil)
+			_, _ = manifestCache.Lookup(context.Background(), key)
+			assert.NoError(GinkgoT(), manifestCache.Add(key, getManifestsCached()))
+			entry := cache.Entry{Revision: "etag", Manifests: getManifestsCached()}
+			assert.Equal(GinkgoT(), cache.EntryCost(entry), manifestCache.Stats().BytesStored)
+
+			manifestCache.Invalidate(key)
+			assert.Equal(GinkgoT(), int64(0), manifestCache.Stats().BytesStored)
+		})
+
+		It("should not count the entries the cache rejects before the set returns", func() {
+			provider.On("Revision", mock.Anything, key, "").Return("etag", nil)
+			rejecting := cache.New(&rejectingCache{metrics: metrics}, new(mocks.HttpClient),
+				cache.WithDefaultRevisionProvider(provider), cache.WithMetrics(metrics))
+			_, _ = rejecting.Lookup(context.Background(), key)
+			assert.Equal(GinkgoT(), int64(0), rejecting.Stats().BytesStored)
+		})
+
+		It("should not count the entries the cache refuses to set", func() {
+			provider.On("Revision", mock.Anything, key, "").Return("etag", nil)
+			refusing := new(mocks.Cache)
+			refusing.On("Get", key.String()).Return(nil, false)
+			refusing.On("Set", key.String(), mock.Anything, mock.Anything).Return(false)
+			refused := cache.New(refusing, new(mocks.HttpClient), cache.WithDefaultRevisionProvider(provider), cache.WithMetrics(metrics))
+			_, _ = refused.Lookup(context.Background(), key)
+			assert.Equal(GinkgoT(), int64(0), refused.Stats().BytesStored)
+		})
+
+		It("should count the evictions of the cache", func() {
+			provider.On("Revision", mock.Anything, key, "").Return("etag", nil)
+			_, _ = manifestCache.Lookup(context.Background(), key)
+			hash, conflict := z.KeyToHash(key.String())
+			metrics.OnEvict(&ristretto.Item{Key: hash, Conflict: conflict, Cost: 1})
+
+			stats := manifestCache.Stats()
+			assert.Equal(GinkgoT(), uint64(1), stats.Evictions)
+			assert.Equal(GinkgoT(), int64(0), stats.BytesStored)
+		})
+	})
+})
+
+// rejectingCache rejects every entry before Set returns, like a ristretto cache whose policy refuses
+// the entry on its own goroutine ahead of the caller
+type rejectingCache struct {
+	metrics *cache.Metrics
+}
+
+func (c *rejectingCache) Get(interface{}) (interface{}, bool) {
+	return nil, false
+}
+
+func (c *rejectingCache) Set(key, _ interface{}, cost int64) bool {
+	hash, conflict := z.KeyToHash(key)
+	c.metrics.OnReject(&ristretto.Item{Key: hash, Conflict: conflict, Cost: cost})
+	return true
+}
+
+func (c *rejectingCache) Del(interface{}) {}
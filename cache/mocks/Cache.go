@@ -9,6 +9,11 @@ type Cache struct {
 	mock.Mock
 }
 
+// Del provides a mock function with given fields: key
+func (_m *Cache) Del(key interface{}) {
+	_m.Called(key)
+}
+
 // Get provides a mock function with given fields: key
 func (_m *Cache) Get(key interface{}) (interface{}, bool) {
 	ret := _m.Called(key)
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisCache is a Cache that stores each Entry on Redis as json, so the replicas of a service share
+// the revisions and manifests and only one of them has to render each source
+type RedisCache struct {
+	client redis.Cmdable
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedisCache instantiates a cache storing its entries with the client under keys starting with prefix,
+// e.g. "lib-kustomize:". Entries expire after ttl, they never expire when it is not positive.
+// Requests run with the timeouts of the client
+func NewRedisCache(client redis.Cmdable, prefix string, ttl time.Duration) *RedisCache {
+	return &RedisCache{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+// Get returns the Entry stored under the key, failed requests and entries that can't be read are reported as missing
+func (c *RedisCache) Get(key interface{}) (interface{}, bool) {
+	data, err := c.client.Get(context.Background(), c.key(key)).Bytes()
+	if err != nil {
+		return nil, false
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+// Set stores the Entry under the key, the cost is ignored. It returns false when the value is not
+// an Entry or the request fails
+func (c *RedisCache) Set(key, value interface{}, _ int64) bool {
+	entry, ok := value.(Entry)
+	if !ok {
+		return false
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return false
+	}
+	ttl := c.ttl
+	if ttl < 0 {
+		ttl = 0
+	}
+	return c.client.Set(context.Background(), c.key(key), data, ttl).Err() == nil
+}
+
+// Del removes the entry of the key
+func (c *RedisCache) Del(key interface{}) {
+	c.client.Del(context.Background(), c.key(key))
+}
+
+// Clear removes every entry under the prefix, keys of other prefixes sharing the database are kept
+func (c *RedisCache) Clear() {
+	ctx := context.Background()
+	iterator := c.client.Scan(ctx, 0, c.prefix+"*", 100).Iterator()
+	for iterator.Next(ctx) {
+		c.client.Del(ctx, iterator.Val())
+	}
+}
+
+func (c *RedisCache) key(key interface{}) string {
+	return c.prefix + fmt.Sprint(key)
+}
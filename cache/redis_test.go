@@ -0,0 +1,92 @@
+package cache_test
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"time"
+)
+
+var _ = Describe("RedisCache", func() {
+	var server *miniredis.Miniredis
+	var client *redis.Client
+	BeforeEach(func() {
+		var err error
+		server, err = miniredis.Run()
+		assert.NoError(GinkgoT(), err)
+		client = redis.NewClient(&redis.Options{Addr: server.Addr()})
+	})
+	AfterEach(func() {
+		_ = client.Close()
+		server.Close()
+	})
+
+	Context("when an entry is set", func() {
+		It("should store it under the prefixed key and return it", func() {
+			redisCache := cache.NewRedisCache(client, "manifests:", 0)
+			assert.True(GinkgoT(), redisCache.Set("key", cache.Entry{Revision: "etag", Manifests: getManifestsCached()}, 1))
+			assert.True(GinkgoT(), server.Exists("manifests:key"))
+			item, got := redisCache.Get("key")
+			assert.True(GinkgoT(), got)
+			entry := item.(cache.Entry)
+			assert.Equal(GinkgoT(), "etag", entry.Revision)
+			assert.Equal(GinkgoT(), 1, len(entry.Manifests))
+			assert.Equal(GinkgoT(), "demo-deployment", entry.Manifests[0].GetName())
+		})
+	})
+
+	Context("when another replica set the entry", func() {
+		It("should return it", func() {
+			other := cache.NewRedisCache(redis.NewClient(&redis.Options{Addr: server.Addr()}), "manifests:", 0)
+			assert.True(GinkgoT(), other.Set("key", cache.Entry{Revision: "etag"}, 1))
+			item, got := cache.NewRedisCache(client, "manifests:", 0).Get("key")
+			assert.True(GinkgoT(), got)
+			assert.Equal(GinkgoT(), "etag", item.(cache.Entry).Revision)
+		})
+	})
+
+	Context("when the cache has a ttl", func() {
+		It("should expire the entries", func() {
+			redisCache := cache.NewRedisCache(client, "manifests:", time.Minute)
+			assert.True(GinkgoT(), redisCache.Set("key", cache.Entry{Revision: "etag"}, 1))
+			assert.Equal(GinkgoT(), time.Minute, server.TTL("manifests:key"))
+			server.FastForward(2 * time.Minute)
+			_, got := redisCache.Get("key")
+			assert.False(GinkgoT(), got)
+		})
+	})
+
+	Context("when entries are deleted", func() {
+		It("should remove them and keep the keys of other prefixes", func() {
+			redisCache := cache.NewRedisCache(client, "manifests:", 0)
+			assert.True(GinkgoT(), redisCache.Set("first", cache.Entry{Revision: "etag"}, 1))
+			assert.True(GinkgoT(), redisCache.Set("second", cache.Entry{Revision: "etag"}, 1))
+			assert.NoError(GinkgoT(), server.Set("other:key", "value"))
+			redisCache.Del("first")
+			assert.False(GinkgoT(), server.Exists("manifests:first"))
+			assert.True(GinkgoT(), server.Exists("manifests:second"))
+			redisCache.Clear()
+			assert.False(GinkgoT(), server.Exists("manifests:second"))
+			assert.True(GinkgoT(), server.Exists("other:key"))
+		})
+	})
+
+	Context("when the value is not an entry", func() {
+		It("should not store it", func() {
+			redisCache := cache.NewRedisCache(client, "manifests:", 0)
+			assert.False(GinkgoT(), redisCache.Set("key", "value", 1))
+		})
+	})
+
+	Context("when redis is unreachable", func() {
+		It("should report the entries as missing", func() {
+			redisCache := cache.NewRedisCache(client, "manifests:", 0)
+			server.Close()
+			assert.False(GinkgoT(), redisCache.Set("key", cache.Entry{Revision: "etag"}, 1))
+			_, got := redisCache.Get("key")
+			assert.False(GinkgoT(), got)
+		})
+	})
+})
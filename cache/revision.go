@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// RevisionProvider fetches the current revision of the repository of a key. The revision is an opaque
+// validator, when it differs from the one stored on cache the manifests of the key are outdated
+type RevisionProvider interface {
+	// Revision returns the current validator of the key, validator is the one stored on cache
+	// and is empty when the key was never validated
+	Revision(ctx context.Context, key Key, validator string) (string, error)
+}
+
+// PathRevisionProvider is a RevisionProvider that can scope the revision to the paths a render depends on,
+// so changes to other paths of the repository don't invalidate it
+type PathRevisionProvider interface {
+	RevisionProvider
+	// PathRevision returns the current revision of the paths of the repository of the key, relative to the
+	// subdirectory of the key, e.g. overlays/dev and base
+	PathRevision(ctx context.Context, key Key, paths []string) (string, error)
+}
+
+// revisionProvider returns the provider registered to the host of the key source,
+// sources of unknown hosts use the default provider and can't be validated when there is none
+func (w Wrapper) revisionProvider(key Key) (RevisionProvider, error) {
+	source, err := ParseSource(key.Source)
+	if err != nil {
+		return nil, err
+	}
+	if provider, ok := w.providers[source.Host]; ok {
+		return provider, nil
+	}
+	if w.defaultProvider == nil {
+		return nil, fmt.Errorf("%w: no revision provider for host %s", ErrUncacheable, source.Host)
+	}
+	return w.defaultProvider, nil
+}
+
+func doRequest(ctx context.Context, httpClient HttpClient, url string, headers map[string]string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		request.Header.Add(key, value)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, &UpstreamError{URL: url, Err: err}
+	}
+	return response, nil
+}
+
+func closeBody(response *http.Response) {
+	if response.Body != nil {
+		_ = response.Body.Close()
+	}
+}
+
+// scopedPaths returns the paths relative to the root of the repository of the key, sorted so the
+// revisions computed from them are deterministic
+func scopedPaths(key Key, paths []string) []string {
+	scoped := make([]string, 0, len(paths))
+	for _, p := range paths {
+		scoped = append(scoped, strings.TrimPrefix(path.Join("/", key.Subdir, p), "/"))
+	}
+	sort.Strings(scoped)
+	return scoped
+}
+
+// pathsRevision combines the revisions of each path into a single opaque revision
+func pathsRevision(paths, revisions []string) string {
+	hash := sha256.New()
+	for i := range paths {
+		hash.Write([]byte(paths[i] + "@" + revisions[i] + "\n"))
+	}
+	return "paths:" + hex.EncodeToString(hash.Sum(nil))
+}
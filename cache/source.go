@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/go-getter"
+)
+
+// ErrInvalidSource is returned when a source can't be parsed into a repository
+var ErrInvalidSource = errors.New("invalid source")
+
+var (
+	forcedGetter = regexp.MustCompile(`^([A-Za-z0-9]+)::(.+)$`)
+	scpLike      = regexp.MustCompile(`^(?:([^@/:]+)@)?([^@/:]+):(.*)$`)
+	validScheme  = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+	validUser    = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	validHost    = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?(:[0-9]+)?$`)
+	validSegment = regexp.MustCompile(`^[A-Za-z0-9._~+@-]+$`)
+	validSubdir  = regexp.MustCompile(`^[A-Za-z0-9._~+@*-]+$`)
+)
+
+// Source is a go-getter source url of a repository parsed into its parts, e.g.
+// git::git@gitlab.com:org/repo.git//sub?ref=main
+type Source struct {
+	// Getter is the forced getter, e.g. git
+	Getter string
+	// Scheme is the url scheme, scp-like sources have the ssh scheme and shorthand ones like github.com/org/repo have none
+	Scheme string
+	User   string
+	Host   string
+	// Path is the repository path as given in the source, e.g. org/repo.git
+	Path string
+	// Owner is the path of the repository without its name, e.g. org or group/subgroup
+	Owner string
+	// Repo is the name of the repository without the .git suffix
+	Repo   string
+	Subdir string
+	Ref    string
+	// Query are the query options of the source other than ref
+	Query url.Values
+}
+
+// ParseSource parses a go-getter source url, returning an error wrapping ErrInvalidSource when the source
+// does not point to a repository
+func ParseSource(raw string) (Source, error) {
+	var s Source
+	src := strings.TrimSpace(raw)
+	if src == "" {
+		return s, invalidSource(raw, "empty source")
+	}
+	if ms := forcedGetter.FindStringSubmatch(src); ms != nil {
+		s.Getter, src = ms[1], ms[2]
+	}
+	src, subdir := getter.SourceDirSubdir(src)
+	s.Subdir = strings.Trim(subdir, "/")
+	if i := strings.Index(src, "?"); i >= 0 {
+		query, err := url.ParseQuery(src[i+1:])
+		if err != nil {
+			return s, invalidSource(raw, err.Error())
+		}
+		s.Ref = query.Get("ref")
+		query.Del("ref")
+		if len(query) > 0 {
+			s.Query = query
+		}
+		src = src[:i]
+	}
+	var path string
+	switch {
+	case strings.Contains(src, "://"):
+		u, err := url.Parse(src)
+		if err != nil {
+			return s, invalidSource(raw, err.Error())
+		}
+		if u.Fragment != "" || u.Opaque != "" {
+			return s, invalidSource(raw, "unexpected url fragment")
+		}
+		s.Scheme, s.Host, path = u.Scheme, u.Host, u.Path
+		if u.User != nil {
+			s.User = u.User.Username()
+		}
+	case scpLike.MatchString(src):
+		ms := scpLike.FindStringSubmatch(src)
+		s.Scheme, s.User, s.Host, path = "ssh", ms[1], ms[2], ms[3]
+	default:
+		i := strings.Index(src, "/")
+		if i < 0 {
+			return s, invalidSource(raw, "missing repository path")
+		}
+		s.Host, path = src[:i], src[i+1:]
+	}
+	s.Host = strings.ToLower(s.Host)
+	s.Path = strings.Trim(path, "/")
+	if err := s.validate(); err != nil {
+		return Source{}, invalidSource(raw, err.Error())
+	}
+	segments := strings.Split(strings.TrimSuffix(s.Path, ".git"), "/")
+	s.Owner, s.Repo = strings.Join(segments[:len(segments)-1], "/"), segments[len(segments)-1]
+	return s, nil
+}
+
+func (s Source) validate() error {
+	if s.Scheme != "" && !validScheme.MatchString(s.Scheme) {
+		return fmt.Errorf("invalid scheme %q", s.Scheme)
+	}
+	if s.User != "" && !validUser.MatchString(s.User) {
+		return fmt.Errorf("invalid user %q", s.User)
+	}
+	if (s.Host != "" || s.Scheme != "file") && !validHost.MatchString(s.Host) {
+		return fmt.Errorf("invalid host %q", s.Host)
+	}
+	segments := strings.Split(strings.TrimSuffix(s.Path, ".git"), "/")
+	if len(segments) < 2 {
+		return errors.New("missing repository owner")
+	}
+	for _, segment := range segments {
+		if !validSegment.MatchString(segment) || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid path segment %q", segment)
+		}
+	}
+	if s.Subdir == "" {
+		return nil
+	}
+	for _, segment := range strings.Split(s.Subdir, "/") {
+		if !validSubdir.MatchString(segment) || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid subdirectory segment %q", segment)
+		}
+	}
+	return nil
+}
+
+// Remote returns the url of the repository as understood by git, shorthand sources default to https
+func (s Source) Remote() string {
+	if s.Scheme == "" {
+		return "https://" + s.Host + "/" + s.Path
+	}
+	var user string
+	if s.User != "" {
+		user = s.User + "@"
+	}
+	return s.Scheme + "://" + user + s.Host + "/" + s.Path
+}
+
+// Repository returns the source of the repository without the subdirectory and the query options
+func (s Source) Repository() string {
+	var getter string
+	if s.Getter != "" {
+		getter = s.Getter + "::"
+	}
+	if s.Scheme == "" {
+		return getter + s.Host + "/" + s.Path
+	}
+	return getter + s.Remote()
+}
+
+// String returns the canonical go-getter source, parsing it again gives the same Source
+func (s Source) String() string {
+	src := s.Repository()
+	if s.Subdir != "" {
+		src += "//" + s.Subdir
+	}
+	query := url.Values{}
+	for name, values := range s.Query {
+		query[name] = values
+	}
+	if s.Ref != "" {
+		query.Set("ref", s.Ref)
+	}
+	if len(query) > 0 {
+		src += "?" + query.Encode()
+	}
+	return src
+}
+
+func invalidSource(source, reason string) error {
+	return fmt.Errorf("%w %q: %s", ErrInvalidSource, source, reason)
+}
@@ -0,0 +1,45 @@
+package cache_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+)
+
+func FuzzParseSource(f *testing.F) {
+	for _, seed := range []string{
+		"github.com/org/repo",
+		"git::git@gitlab.com:org/repo.git//sub?ref=main",
+		"git::https://github.com/org/repo.git/",
+		"git::ssh://git@example.com:2222/group/subgroup/repo.git//a/b?ref=v1&depth=1",
+		"git::file:///tmp/repos/repo.git",
+		"https://example.com/org/repo?archive=zip",
+		"org/repo",
+		"host/org/.git",
+		"repo",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		source, err := cache.ParseSource(raw)
+		if err != nil {
+			if !errors.Is(err, cache.ErrInvalidSource) {
+				t.Fatalf("unexpected error parsing %q: %v", raw, err)
+			}
+			return
+		}
+		if source.Owner == "" || source.Repo == "" {
+			t.Fatalf("missing owner or repository parsing %q: %#v", raw, source)
+		}
+		again, err := cache.ParseSource(source.String())
+		if err != nil {
+			t.Fatalf("failed to parse canonical source %q of %q: %v", source.String(), raw, err)
+		}
+		if !reflect.DeepEqual(source, again) {
+			t.Fatalf("canonical source %q of %q parsed into %#v, want %#v", source.String(), raw, again, source)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package cache_test
+
+import (
+	"errors"
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"net/url"
+)
+
+var _ = Describe("Source", func() {
+	Context("when the source is a forced git scp-like url with subdirectory and ref", func() {
+		It("should parse all the parts", func() {
+			source, err := cache.ParseSource("git::git@gitlab.com:group/subgroup/repo.git//sub/dir?ref=main&depth=1")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), cache.Source{
+				Getter: "git",
+				Scheme: "ssh",
+				User:   "git",
+				Host:   "gitlab.com",
+				Path:   "group/subgroup/repo.git",
+				Owner:  "group/subgroup",
+				Repo:   "repo",
+				Subdir: "sub/dir",
+				Ref:    "main",
+				Query:  url.Values{"depth": []string{"1"}},
+			}, source)
+			assert.Equal(GinkgoT(), "ssh://git@gitlab.com/group/subgroup/repo.git", source.Remote())
+			assert.Equal(GinkgoT(), "git::ssh://git@gitlab.com/group/subgroup/repo.git//sub/dir?depth=1&ref=main", source.String())
+		})
+	})
+
+	Context("when the source is a shorthand github url", func() {
+		It("should parse owner and repository", func() {
+			source, err := cache.ParseSource("github.com/org/repo")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), "github.com", source.Host)
+			assert.Equal(GinkgoT(), "org", source.Owner)
+			assert.Equal(GinkgoT(), "repo", source.Repo)
+			assert.Equal(GinkgoT(), "", source.Scheme)
+			assert.Equal(GinkgoT(), "https://github.com/org/repo", source.Remote())
+		})
+	})
+
+	Context("when the source is an https url with .git suffix and trailing slash", func() {
+		It("should drop them from the repository name", func() {
+			source, err := cache.ParseSource("git::https://GitHub.com/org/repo.git/")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), "github.com", source.Host)
+			assert.Equal(GinkgoT(), "org", source.Owner)
+			assert.Equal(GinkgoT(), "repo", source.Repo)
+			assert.Equal(GinkgoT(), "git::https://github.com/org/repo.git", source.Repository())
+		})
+	})
+
+	Context("when the source is a file url", func() {
+		It("should parse it without host", func() {
+			source, err := cache.ParseSource("git::file:///tmp/repos/repo.git?ref=v1")
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), "", source.Host)
+			assert.Equal(GinkgoT(), "tmp/repos", source.Owner)
+			assert.Equal(GinkgoT(), "file:///tmp/repos/repo.git", source.Remote())
+		})
+	})
+
+	Context("when the source does not point to a repository", func() {
+		It("should return a validation error instead of panicking", func() {
+			for _, raw := range []string{"", "repo", "github.com", "github.com/repo", "./manifests", "https://github.com/org/repo#main", "git@:org/repo", "github.com/org/../repo", "https://github.com/%zz/repo"} {
+				_, err := cache.ParseSource(raw)
+				assert.True(GinkgoT(), errors.Is(err, cache.ErrInvalidSource), raw)
+			}
+		})
+	})
+})
@@ -0,0 +1,112 @@
+package cache
+
+import "sync/atomic"
+
+// TieredCache is a Cache that checks a fast upper tier, e.g. an in-memory ristretto cache, before a slower
+// shared lower tier, e.g. a RedisCache. Entries found on the lower tier are filled on the upper one
+type TieredCache struct {
+	// counters are first on the struct so they are aligned for atomic operations on 32 bit platforms
+	upperHits   uint64
+	upperMisses uint64
+	lowerHits   uint64
+	lowerMisses uint64
+	upper       Cache
+	lower       Cache
+	cost        CostFunc
+}
+
+// TierStats counts the lookups of a tier
+type TierStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// TieredStats counts the lookups of each tier of a TieredCache, the lower tier is only checked on upper misses
+type TieredStats struct {
+	Upper TierStats
+	Lower TierStats
+}
+
+// TieredOption configures a TieredCache
+type TieredOption func(*TieredCache)
+
+// WithFillCost sets the cost of the entries filled on the upper tier, it should be the CostFunc of the
+// wrapper so filled entries weigh the same as the ones it sets. It is EntryCost by default
+func WithFillCost(cost CostFunc) TieredOption {
+	return func(c *TieredCache) {
+		c.cost = cost
+	}
+}
+
+// NewTieredCache instantiates a cache checking upper before lower
+func NewTieredCache(upper, lower Cache, options ...TieredOption) *TieredCache {
+	c := &TieredCache{upper: upper, lower: lower, cost: EntryCost}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Get returns the value of the key from the first tier that has it
+func (c *TieredCache) Get(key interface{}) (interface{}, bool) {
+	if value, got := c.upper.Get(key); got {
+		atomic.AddUint64(&c.upperHits, 1)
+		return value, true
+	}
+	atomic.AddUint64(&c.upperMisses, 1)
+	value, got := c.lower.Get(key)
+	if !got {
+		atomic.AddUint64(&c.lowerMisses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.lowerHits, 1)
+	c.upper.Set(key, value, c.valueCost(value))
+	return value, true
+}
+
+// Set stores the value on both tiers, it returns false only when neither of them stored it
+func (c *TieredCache) Set(key, value interface{}, cost int64) bool {
+	lower := c.lower.Set(key, value, cost)
+	upper := c.upper.Set(key, value, cost)
+	return lower || upper
+}
+
+// Del removes the key from both tiers
+func (c *TieredCache) Del(key interface{}) {
+	c.lower.Del(key)
+	c.upper.Del(key)
+}
+
+// Clear removes every entry of the tiers implementing Clearer
+func (c *TieredCache) Clear() {
+	for _, tier := range []Cache{c.lower, c.upper} {
+		if clearer, ok := tier.(Clearer); ok {
+			clearer.Clear()
+		}
+	}
+}
+
+// Wait blocks until the buffered writes of the tiers are applied
+func (c *TieredCache) Wait() {
+	for _, tier := range []Cache{c.upper, c.lower} {
+		if waiter, ok := tier.(Waiter); ok {
+			waiter.Wait()
+		}
+	}
+}
+
+// Stats returns the hits and misses of each tier since the cache was instantiated
+func (c *TieredCache) Stats() TieredStats {
+	return TieredStats{
+		Upper: TierStats{Hits: atomic.LoadUint64(&c.upperHits), Misses: atomic.LoadUint64(&c.upperMisses)},
+		Lower: TierStats{Hits: atomic.LoadUint64(&c.lowerHits), Misses: atomic.LoadUint64(&c.lowerMisses)},
+	}
+}
+
+// valueCost returns the cost of the values filled on the upper tier, their original cost is not stored on the lower one
+func (c *TieredCache) valueCost(value interface{}) int64 {
+	if entry, ok := value.(Entry); ok {
+		return c.cost(entry)
+	}
+	return 1
+}
@@ -0,0 +1,102 @@
+package cache_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"github.com/thallesfreitaszup/lib-kustomize/cache/mocks"
+)
+
+var _ = Describe("TieredCache", func() {
+	var upper *mocks.Cache
+	var lower *mocks.Cache
+	var entry cache.Entry
+	BeforeEach(func() {
+		upper = new(mocks.Cache)
+		lower = new(mocks.Cache)
+		entry = cache.Entry{Revision: "etag", Manifests: getManifestsCached()}
+	})
+
+	Context("when the upper tier has the key", func() {
+		It("should return it without checking the lower tier", func() {
+			upper.On("Get", "key").Return(entry, true)
+			tiered := cache.NewTieredCache(upper, lower)
+			value, got := tiered.Get("key")
+			assert.True(GinkgoT(), got)
+			assert.Equal(GinkgoT(), entry, value)
+			lower.AssertNotCalled(GinkgoT(), "Get", mock.Anything)
+			assert.Equal(GinkgoT(), cache.TieredStats{Upper: cache.TierStats{Hits: 1}}, tiered.Stats())
+		})
+	})
+
+	Context("when only the lower tier has the key", func() {
+		It("should return it and fill the upper tier", func() {
+			upper.On("Get", "key").Return(nil, false)
+			lower.On("Get", "key").Return(entry, true)
+			upper.On("Set", "key", entry, cache.EntryCost(entry)).Times(1).Return(true)
+			tiered := cache.NewTieredCache(upper, lower)
+			value, got := tiered.Get("key")
+			assert.True(GinkgoT(), got)
+			assert.Equal(GinkgoT(), entry, value)
+			upper.AssertExpectations(GinkgoT())
+			assert.Equal(GinkgoT(), cache.TieredStats{Upper: cache.TierStats{Misses: 1}, Lower: cache.TierStats{Hits: 1}}, tiered.Stats())
+		})
+	})
+
+	Context("when the cache has a fill cost", func() {
+		It("should fill the upper tier with the cost of the entry", func() {
+			upper.On("Get", "key").Return(nil, false)
+			lower.On("Get", "key").Return(entry, true)
+			upper.On("Set", "key", entry, int64(1)).Times(1).Return(true)
+			tiered := cache.NewTieredCache(upper, lower, cache.WithFillCost(func(cache.Entry) int64 { return 1 }))
+			_, got := tiered.Get("key")
+			assert.True(GinkgoT(), got)
+			upper.AssertExpectations(GinkgoT())
+		})
+	})
+
+	Context("when no tier has the key", func() {
+		It("should report it as missing", func() {
+			upper.On("Get", "key").Return(nil, false)
+			lower.On("Get", "key").Return(nil, false)
+			tiered := cache.NewTieredCache(upper, lower)
+			_, got := tiered.Get("key")
+			assert.False(GinkgoT(), got)
+			assert.Equal(GinkgoT(), cache.TieredStats{Upper: cache.TierStats{Misses: 1}, Lower: cache.TierStats{Misses: 1}}, tiered.Stats())
+		})
+	})
+
+	Context("when a value is set", func() {
+		It("should store it on both tiers", func() {
+			upper.On("Set", "key", entry, int64(1)).Times(1).Return(false)
+			lower.On("Set", "key", entry, int64(1)).Times(1).Return(true)
+			tiered := cache.NewTieredCache(upper, lower)
+			assert.True(GinkgoT(), tiered.Set("key", entry, 1))
+			upper.AssertExpectations(GinkgoT())
+			lower.AssertExpectations(GinkgoT())
+		})
+
+		It("should fail when no tier stores it", func() {
+			upper.On("Set", "key", entry, int64(1)).Return(false)
+			lower.On("Set", "key", entry, int64(1)).Return(false)
+			tiered := cache.NewTieredCache(upper, lower)
+			assert.False(GinkgoT(), tiered.Set("key", entry, 1))
+		})
+	})
+
+	Context("when the wrapper uses the tiered cache", func() {
+		It("should return the manifests stored on the lower tier", func() {
+			provider := new(mocks.RevisionProvider)
+			key := cache.NewKey("example.com/org/source", "overlays/dev", "")
+			upper.On("Get", key.String()).Return(nil, false)
+			lower.On("Get", key.String()).Return(entry, true)
+			upper.On("Set", key.String(), entry, cache.EntryCost(entry)).Return(true)
+			provider.On("Revision", mock.Anything, key, "etag").Return("etag", nil)
+			manifestCache := cache.New(cache.NewTieredCache(upper, lower), new(mocks.HttpClient), cache.WithDefaultRevisionProvider(provider))
+			manifests, err := manifestCache.GetManifests(key)
+			assert.Equal(GinkgoT(), err, nil)
+			assert.Equal(GinkgoT(), len(manifests), 1)
+		})
+	})
+})
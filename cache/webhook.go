@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxPayloadSize is the size GitHub caps the payloads of webhooks to
+const maxPayloadSize = 25 << 20
+
+// WebhookHandler is an http.Handler receiving the push webhooks of GitHub and GitLab, invalidating the
+// entries of the pushed refs so they are rendered again on the next lookup instead of waiting for the
+// revision check to notice the change.
+// GitHub payloads are verified with their HMAC signature and GitLab ones with their secret token,
+// hooks of a provider without a secret configured are refused
+type WebhookHandler struct {
+	wrapper      Wrapper
+	githubSecret []byte
+	gitlabToken  string
+	onPush       func(keys []Key)
+}
+
+// WebhookOption configures a WebhookHandler
+type WebhookOption func(*WebhookHandler)
+
+// WithGitHubSecret accepts the GitHub webhooks signed with secret
+func WithGitHubSecret(secret string) WebhookOption {
+	return func(h *WebhookHandler) {
+		h.githubSecret = []byte(secret)
+	}
+}
+
+// WithGitLabToken accepts the GitLab webhooks sent with the secret token
+func WithGitLabToken(token string) WebhookOption {
+	return func(h *WebhookHandler) {
+		h.gitlabToken = token
+	}
+}
+
+// WithPushHandler calls onPush on background with the keys invalidated by each push, e.g. to render them
+// again eagerly so the next lookup finds them on cache
+func WithPushHandler(onPush func(keys []Key)) WebhookOption {
+	return func(h *WebhookHandler) {
+		h.onPush = onPush
+	}
+}
+
+// NewWebhookHandler instantiates a handler invalidating the entries of wrapper.
+// Pushes only invalidate the keys the wrapper looked up since it was instantiated. When replicas share a Cache,
+// e.g. a RedisCache, the entries of keys looked up only by the replica that didn't receive the webhook stay
+// until their revision check finds the change, so deliver the webhook to every replica or keep revision checks on
+func NewWebhookHandler(wrapper Wrapper, options ...WebhookOption) *WebhookHandler {
+	h := &WebhookHandler{wrapper: wrapper}
+	for _, option := range options {
+		option(h)
+	}
+	return h
+}
+
+type push struct {
+	// webURL is the url of the repository page, its host and path identify the repository
+	webURL        string
+	ref           string
+	defaultBranch string
+}
+
+func (h *WebhookHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxPayloadSize))
+	if err != nil {
+		http.Error(writer, "error reading payload", http.StatusBadRequest)
+		return
+	}
+	var event push
+	var ok bool
+	switch {
+	case request.Header.Get("X-GitHub-Event") != "":
+		if !h.validGitHubSignature(request.Header.Get("X-Hub-Signature-256"), body) {
+			http.Error(writer, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		event, ok, err = parseGitHubPush(request.Header.Get("X-GitHub-Event"), body)
+	case request.Header.Get("X-Gitlab-Event") != "":
+		if !h.validGitLabToken(request.Header.Get("X-Gitlab-Token")) {
+			http.Error(writer, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		event, ok, err = parseGitLabPush(request.Header.Get("X-Gitlab-Event"), body)
+	default:
+		http.Error(writer, "unknown webhook", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		// pings and events other than pushes are acknowledged and ignored
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	repository, err := url.Parse(event.webURL)
+	if err != nil || repository.Host == "" {
+		http.Error(writer, "invalid repository url", http.StatusBadRequest)
+		return
+	}
+	keys := h.wrapper.InvalidatePush(repository.Host, repository.Path, event.ref, event.defaultBranch)
+	if h.onPush != nil && len(keys) > 0 {
+		go h.onPush(keys)
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// validGitHubSignature checks the X-Hub-Signature-256 header, the hex HMAC-SHA256 of the payload
+// ( https://docs.github.com/en/developers/webhooks-and-events/webhooks/securing-your-webhooks )
+func (h *WebhookHandler) validGitHubSignature(signature string, body []byte) bool {
+	if len(h.githubSecret) == 0 || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.githubSecret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func (h *WebhookHandler) validGitLabToken(token string) bool {
+	return h.gitlabToken != "" && subtle.ConstantTimeCompare([]byte(h.gitlabToken), []byte(token)) == 1
+}
+
+// parseGitHubPush parses the payload of push events, reporting false for other events
+// ( https://docs.github.com/en/developers/webhooks-and-events/webhooks/webhook-events-and-payloads#push )
+func parseGitHubPush(event string, body []byte) (push, bool, error) {
+	if event != "push" {
+		return push{}, false, nil
+	}
+	var payload struct {
+		Ref        string `json:"ref"`
+		Repository struct {
+			HTMLURL       string `json:"html_url"`
+			DefaultBranch string `json:"default_branch"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return push{}, false, err
+	}
+	return push{webURL: payload.Repository.HTMLURL, ref: payload.Ref, defaultBranch: payload.Repository.DefaultBranch}, true, nil
+}
+
+// parseGitLabPush parses the payload of push and tag push events, reporting false for other events
+// ( https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events )
+func parseGitLabPush(event string, body []byte) (push, bool, error) {
+	if event != "Push Hook" && event != "Tag Push Hook" {
+		return push{}, false, nil
+	}
+	var payload struct {
+		Ref     string `json:"ref"`
+		Project struct {
+			WebURL        string `json:"web_url"`
+			DefaultBranch string `json:"default_branch"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return push{}, false, err
+	}
+	return push{webURL: payload.Project.WebURL, ref: payload.Ref, defaultBranch: payload.Project.DefaultBranch}, true, nil
+}
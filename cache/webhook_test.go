@@ -0,0 +1,166 @@
+package cache_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/dgraph-io/ristretto"
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"github.com/thallesfreitaszup/lib-kustomize/cache/mocks"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("WebhookHandler", func() {
+	var ristrettoCache *ristretto.Cache
+	var manifestCache cache.Wrapper
+	var defaultBranch cache.Key
+	var main cache.Key
+	var dev cache.Key
+	var tag cache.Key
+	var otherTag cache.Key
+	BeforeEach(func() {
+		var err error
+		ristrettoCache, err = ristretto.NewCache(&ristretto.Config{
+			NumCounters: 1e4,
+			MaxCost:     1 << 20,
+			BufferItems: 64,
+		})
+		assert.NoError(GinkgoT(), err)
+		provider := new(mocks.RevisionProvider)
+		provider.On("Revision", mock.Anything, mock.Anything, mock.Anything).Return("etag", nil)
+		manifestCache = cache.New(ristrettoCache, new(mocks.HttpClient), cache.WithDefaultRevisionProvider(provider),
+			cache.WithRevisionProvider("github.com", provider), cache.WithRevisionProvider("gitlab.com", provider))
+		defaultBranch = cache.NewKey("github.com/org/kustomize-demo", "overlays/dev", "")
+		main = cache.NewKey("git::https://github.com/org/kustomize-demo.git?ref=main", "overlays/prod", "")
+		dev = cache.NewKey("github.com/org/kustomize-demo?ref=dev", "overlays/dev", "")
+		tag = cache.NewKey("git::git@gitlab.com:group/subgroup/example.git?ref=v1.0.0", "overlays/dev", "")
+		otherTag = cache.NewKey("gitlab.com/group/subgroup/example?ref=v0.9.0", "overlays/dev", "")
+		for _, key := range []cache.Key{defaultBranch, main, dev, tag, otherTag} {
+			_, err := manifestCache.GetManifests(key)
+			assert.ErrorIs(GinkgoT(), err, cache.ErrNotCached)
+			assert.NoError(GinkgoT(), manifestCache.Add(key, getManifestsCached()))
+		}
+	})
+	AfterEach(func() {
+		ristrettoCache.Close()
+	})
+
+	cached := func(key cache.Key) bool {
+		_, err := manifestCache.GetManifests(key)
+		return err == nil
+	}
+
+	Context("when GitHub sends a signed push", func() {
+		It("should invalidate the keys of the pushed branch", func() {
+			pushed := make(chan []cache.Key, 1)
+			handler := cache.NewWebhookHandler(manifestCache, cache.WithGitHubSecret("secret"), cache.WithPushHandler(func(keys []cache.Key) {
+				pushed <- keys
+			}))
+			payload := readPayload("github_push.json")
+			request := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+			request.Header.Set("X-GitHub-Event", "push")
+			request.Header.Set("X-Hub-Signature-256", "sha256="+sign("secret", payload))
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			assert.Equal(GinkgoT(), http.StatusNoContent, recorder.Code)
+			assert.False(GinkgoT(), cached(defaultBranch))
+			assert.False(GinkgoT(), cached(main))
+			assert.True(GinkgoT(), cached(dev))
+			assert.True(GinkgoT(), cached(tag))
+			select {
+			case keys := <-pushed:
+				assert.ElementsMatch(GinkgoT(), []cache.Key{defaultBranch, main}, keys)
+			case <-time.After(time.Second):
+				Fail("the push handler was not called")
+			}
+		})
+	})
+
+	Context("when the GitHub signature is invalid", func() {
+		It("should refuse the webhook", func() {
+			handler := cache.NewWebhookHandler(manifestCache, cache.WithGitHubSecret("secret"))
+			payload := readPayload("github_push.json")
+			request := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+			request.Header.Set("X-GitHub-Event", "push")
+			request.Header.Set("X-Hub-Signature-256", "sha256="+sign("other", payload))
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			assert.Equal(GinkgoT(), http.StatusUnauthorized, recorder.Code)
+			assert.True(GinkgoT(), cached(defaultBranch))
+		})
+	})
+
+	Context("when GitHub sends a ping", func() {
+		It("should acknowledge it", func() {
+			handler := cache.NewWebhookHandler(manifestCache, cache.WithGitHubSecret("secret"))
+			payload := []byte(`{"zen":"Keep it logically awesome."}`)
+			request := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+			request.Header.Set("X-GitHub-Event", "ping")
+			request.Header.Set("X-Hub-Signature-256", "sha256="+sign("secret", payload))
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			assert.Equal(GinkgoT(), http.StatusNoContent, recorder.Code)
+		})
+	})
+
+	Context("when GitLab sends a tag push with the secret token", func() {
+		It("should invalidate the keys of the pushed tag", func() {
+			handler := cache.NewWebhookHandler(manifestCache, cache.WithGitLabToken("token"))
+			request := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(readPayload("gitlab_tag_push.json")))
+			request.Header.Set("X-Gitlab-Event", "Tag Push Hook")
+			request.Header.Set("X-Gitlab-Token", "token")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			assert.Equal(GinkgoT(), http.StatusNoContent, recorder.Code)
+			assert.False(GinkgoT(), cached(tag))
+			assert.True(GinkgoT(), cached(otherTag))
+			assert.True(GinkgoT(), cached(defaultBranch))
+		})
+	})
+
+	Context("when the handler has no token for GitLab", func() {
+		It("should refuse the webhook", func() {
+			handler := cache.NewWebhookHandler(manifestCache, cache.WithGitHubSecret("secret"))
+			request := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(readPayload("gitlab_tag_push.json")))
+			request.Header.Set("X-Gitlab-Event", "Tag Push Hook")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			assert.Equal(GinkgoT(), http.StatusUnauthorized, recorder.Code)
+			assert.True(GinkgoT(), cached(tag))
+		})
+	})
+
+	Context("when the request is not a post", func() {
+		It("should refuse it", func() {
+			handler := cache.NewWebhookHandler(manifestCache)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/webhook", nil))
+			assert.Equal(GinkgoT(), http.StatusMethodNotAllowed, recorder.Code)
+		})
+	})
+})
+
+func readPayload(name string) []byte {
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	assert.NoError(GinkgoT(), err)
+	return payload
+}
+
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -18,17 +18,20 @@ import (
 )
 
 func main() {
+	metrics := cache.NewMetrics()
 	cacheClient, err := ristretto.NewCache(&ristretto.Config{
 		NumCounters: 1e7,     // number of keys to track frequency of (10M).
-		MaxCost:     1 << 30, // maximum cost of cache (1GB).
+		MaxCost:     1 << 30, // maximum cost of cache (1GB), entries cost their size in bytes.
 		BufferItems: 64,      // number of keys per Get buffer.
+		OnEvict:     metrics.OnEvict,
+		OnReject:    metrics.OnReject,
 	})
 	if err != nil {
 		panic(err)
 	}
-	wrapper := cache.New(cacheClient, &http.Client{})
-	kustomizer := krusty.MakeKustomizer(
-		build.HonorKustomizeFlags(krusty.MakeDefaultOptions()))
+	wrapper := cache.New(cacheClient, &http.Client{}, cache.WithMetrics(metrics))
+	options := build.HonorKustomizeFlags(krusty.MakeDefaultOptions())
+	kustomizer := krusty.MakeKustomizer(options)
 	pwd, err := os.Getwd()
 	client := getter.Client{
 		Pwd:  pwd,
@@ -38,7 +41,8 @@ func main() {
 		Dst:  filepath.Join(os.TempDir(), "kustomize"+strconv.Itoa(int(z.FastRand()))),
 	}
 	path := "overlays/dev"
-	k := kustomize.New(kustomizer, &client, client.Dst, client.Src, path, wrapper)
+	k := kustomize.New(kustomizer, kustomize.GoGetter{Client: &client}, client.Dst, client.Src, path, wrapper)
+	k.Options = options
 	manifests, err := k.Render()
 	if err != nil {
 		panic(err)
@@ -52,4 +56,7 @@ func main() {
 	}
 	bytes, err = json.Marshal(manifests)
 	fmt.Println(string(bytes))
+
+	stats := wrapper.Stats()
+	fmt.Printf("hit ratio %.2f, %d revision checks, %d bytes stored\n", stats.HitRatio(), stats.RevisionChecks, stats.BytesStored)
 }
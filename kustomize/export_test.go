@@ -0,0 +1,8 @@
+package kustomize
+
+// LockedDestinations returns the destinations with renders holding or waiting for their lock
+func LockedDestinations() int {
+	destinations.mu.Lock()
+	defer destinations.mu.Unlock()
+	return len(destinations.locks)
+}
@@ -1,31 +1,93 @@
 package kustomize
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/hashicorp/go-getter"
 	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"golang.org/x/sync/singleflight"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"path/filepath"
+	"sigs.k8s.io/kustomize/api/krusty"
 	"sigs.k8s.io/kustomize/api/resmap"
 	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sync"
 )
 
+// renders coalesces the concurrent renders of the same cache key to the same destination, so the source is
+// downloaded and built only once while the other callers wait for the shared result
+var renders singleflight.Group
+
+// destinations serializes the downloads and builds on each destination directory. A render abandoned by its
+// caller keeps the destination until its download and build are done, so the next one doesn't download over it
+var destinations = &destinationLocks{locks: map[string]*destinationLock{}}
+
+// serialRuns serializes the runs of every SerialRenderer of the process
+var serialRuns sync.Mutex
+
 type Renderer interface {
 	Run(fSys filesys.FileSystem, path string) (resmap.ResMap, error)
 }
 
+// SerialRenderer runs the Renderer it wraps one build at a time across every SerialRenderer of the process,
+// for renderers that aren't safe for concurrent builds. Lookups and downloads still run in parallel, but the
+// revisions of remote bases are fetched while their kustomizations are read, so they are fetched under the lock
+type SerialRenderer struct {
+	Renderer
+}
+
+// Run waits for the runs of the other serial renderers before running the wrapped renderer
+func (r SerialRenderer) Run(fSys filesys.FileSystem, path string) (resmap.ResMap, error) {
+	serialRuns.Lock()
+	defer serialRuns.Unlock()
+	return r.Renderer.Run(fSys, path)
+}
+
 type Getter interface {
 	Get() error
 }
 
+// ContextGetter is a Getter that stops the download when the context is done, when the
+// client of the wrapper implements it the context of RenderContext is passed to the download
+type ContextGetter interface {
+	Getter
+	GetContext(ctx context.Context) error
+}
+
+// GoGetter adapts a go-getter client to a ContextGetter, every download runs with the
+// context of the render instead of the one the client was built with
+type GoGetter struct {
+	*getter.Client
+}
+
+// GetContext downloads the source of the client canceling the download when the context is done
+func (g GoGetter) GetContext(ctx context.Context) error {
+	client := *g.Client
+	client.Ctx = ctx
+	return client.Get()
+}
+
 type KustomizerWrapper struct {
-	FSys        filesys.FileSystem
+	FSys filesys.FileSystem
+	// Renderer builds the downloaded source, the renders of different destinations run it concurrently
+	// unless it is wrapped in a SerialRenderer
 	Renderer    Renderer
 	Client      Getter
 	Destination string
 	Source      string
 	Path        string
 	Cache       cache.Wrapper
+	// Options are the options the Renderer was built with, they are part of the cache key
+	// so renders with different options are stored apart
+	Options *krusty.Options
+	// ReuseUnchanged stores a digest of the files each render reads, when the source revision changes but
+	// the files the manifests were rendered from are byte identical the cached manifests are reused
+	// instead of running the Renderer again
+	ReuseUnchanged bool
 }
 
 // New Instantiate a new Wrapper of Kustomize that will do the `kustomize build` of the source
@@ -38,39 +100,287 @@ func New(kustomizer Renderer, client Getter, destination, source, path string, c
 // Render downloads the content of the source url and calls the kustomizer run to do the build of
 // manifests stored on source
 func (k KustomizerWrapper) Render() ([]unstructured.Unstructured, error) {
-	var unstructuredManifests []unstructured.Unstructured
-	var manifests, err = k.Cache.GetManifests(k.Source)
+	return k.RenderContext(context.Background())
+}
+
+// RenderContext is like Render but gives up when the context is done, canceling the conditional request
+// and the download. The kustomizer run can't be interrupted, so it keeps running on background and its
+// result is discarded, renders to the same destination wait until it is done.
+// The source is only downloaded on a cache miss, failures checking the cache are returned as is.
+// Sources the cache can't validate, like local paths, are rendered without being cached.
+// Concurrent renders of the same cache key to the same destination share a single download and build
+func (k KustomizerWrapper) RenderContext(ctx context.Context) ([]unstructured.Unstructured, error) {
+	result, err := k.RenderResult(ctx)
+	return result.Manifests, err
+}
+
+// RenderResult is like RenderContext but reports if the manifests were served stale from cache
+// because the source revision could not be checked
+func (k KustomizerWrapper) RenderResult(ctx context.Context) (cache.Result, error) {
+	key := k.CacheKey()
+	result, err := k.Cache.Lookup(ctx, key)
 	if err == nil {
-		return manifests, nil
+		return result, nil
+	}
+	if !isCacheMiss(err) {
+		return cache.Result{}, err
+	}
+	manifests, shared, err := k.renderMiss(ctx, key, err)
+	if err != nil {
+		return cache.Result{}, err
 	}
-	err = k.getSourceContent()
+	if shared {
+		manifests, err = cache.CopyManifests(manifests)
+		if err != nil {
+			return cache.Result{}, err
+		}
+	}
+	return cache.Result{Manifests: manifests}, nil
+}
+
+// Refresh checks the source revision and renders the manifests again when they are missing or outdated on cache,
+// like RenderResult, but doesn't copy or decode the manifests, so refreshing unchanged sources is cheap
+func (k KustomizerWrapper) Refresh(ctx context.Context) error {
+	key := k.CacheKey()
+	err := k.Cache.Validate(ctx, key)
+	if err == nil || !isCacheMiss(err) {
+		return err
+	}
+	_, _, err = k.renderMiss(ctx, key, err)
+	return err
+}
+
+// renderMiss renders the manifests after the lookup of the key missed with err, sharing the render with the
+// concurrent callers of its group. Shared manifests must be copied before they are handed to the caller
+func (k KustomizerWrapper) renderMiss(ctx context.Context, key cache.Key, err error) ([]unstructured.Unstructured, bool, error) {
+	cacheable := !errors.Is(err, cache.ErrInvalidSource) && !errors.Is(err, cache.ErrUncacheable)
+	render := func() (interface{}, error) {
+		return k.render(ctx, key, cacheable)
+	}
+	group := k.renderGroup(key)
+	results := renders.DoChan(group, render)
+	for {
+		select {
+		case r := <-results:
+			if r.Shared && isContextError(r.Err) && ctx.Err() == nil {
+				// the render was started by a caller that gave up, this one still has time to render
+				results = renders.DoChan(group, render)
+				continue
+			}
+			if r.Err != nil {
+				return nil, false, r.Err
+			}
+			return r.Val.([]unstructured.Unstructured), r.Shared, nil
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// renderGroup identifies the renders that can share their result, the ones of the same key
+// downloaded to the same destination and stored on the same cache
+func (k KustomizerWrapper) renderGroup(key cache.Key) string {
+	return filepath.Clean(k.Destination) + "\x00" + k.Cache.ID() + "\x00" + key.String()
+}
+
+// render downloads and builds the source once the destination is free, giving up when the context is done
+func (k KustomizerWrapper) render(ctx context.Context, key cache.Key, cacheable bool) ([]unstructured.Unstructured, error) {
+	destination := filepath.Clean(k.Destination)
+	if err := destinations.lock(ctx, destination); err != nil {
+		return nil, err
+	}
+	type result struct {
+		manifests []unstructured.Unstructured
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer destinations.unlock(destination)
+		defer func() {
+			// the build runs on its own goroutine, where a panic of the renderer would crash the process
+			if p := recover(); p != nil {
+				done <- result{err: fmt.Errorf("panic rendering %s: %v", filepath.Join(k.Destination, k.Path), p)}
+			}
+		}()
+		manifests, err := k.build(ctx, key, cacheable)
+		done <- result{manifests: manifests, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.manifests, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// build downloads and builds the source, storing the manifests on cache when it is cacheable
+func (k KustomizerWrapper) build(ctx context.Context, key cache.Key, cacheable bool) ([]unstructured.Unstructured, error) {
+	var unstructuredManifests []unstructured.Unstructured
+	err := k.getSourceContent(ctx)
 	if err != nil {
-		return unstructuredManifests, err
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	resMap, err := k.Renderer.Run(k.FSys, filepath.Join(k.Destination, k.Path))
+	if cacheable && k.ReuseUnchanged {
+		if manifests, ok := k.reuse(key); ok {
+			return manifests, nil
+		}
+	}
+	fSys := k.FSys
+	var reads *readRecorder
+	if cacheable {
+		reads = &readRecorder{FileSystem: k.FSys, resolve: func(source string) string {
+			// a remote whose revision can't be fetched is stored without it, so the next lookup renders again
+			revision, _ := k.Cache.RemoteRevision(ctx, source)
+			return revision
+		}}
+		fSys = reads
+	}
+	resMap, err := k.Renderer.Run(fSys, filepath.Join(k.Destination, k.Path))
 	if err != nil {
-		return unstructuredManifests, err
+		return nil, err
 	}
 	resources, err := json.Marshal(resMap.Resources())
 	if err != nil {
-		return unstructuredManifests, fmt.Errorf("error marshalling kustomize resources: %w", err)
+		return nil, fmt.Errorf("error marshalling kustomize resources: %w", err)
 	}
 	err = json.Unmarshal(resources, &unstructuredManifests)
 	if err != nil {
-		return unstructuredManifests, fmt.Errorf("error converting kustomize resources to unstructured manifests %w", err)
+		return nil, fmt.Errorf("error converting kustomize resources to unstructured manifests %w", err)
 	}
-	err = k.Cache.Add(k.Source, unstructuredManifests)
-	if err != nil {
+	if !cacheable {
+		return unstructuredManifests, nil
+	}
+	if reads != nil {
+		err = k.Cache.AddInputs(ctx, key, unstructuredManifests, k.inputs(reads))
+	} else {
+		err = k.Cache.Add(key, unstructuredManifests)
+	}
+	// manifests that can't be stored are still returned, the next render builds them again
+	if err != nil && !errors.Is(err, cache.ErrUncacheable) {
 		return nil, err
 	}
 	return unstructuredManifests, nil
 }
 
-func (k KustomizerWrapper) getSourceContent() error {
+// inputs describes the files and remote sources read by a render, the digest is left empty when the render
+// read files outside the destination, like remote bases, since their changes are tracked by revision instead
+func (k KustomizerWrapper) inputs(reads *readRecorder) cache.Inputs {
+	inputs := cache.Inputs{Paths: reads.dirs(k.Destination), Remotes: reads.remotes()}
+	if !k.ReuseUnchanged || len(inputs.Remotes) > 0 {
+		return inputs
+	}
+	files, inside := reads.relative(k.Destination)
+	if !inside || len(files) == 0 {
+		return inputs
+	}
+	sum, err := digest(k.FSys, k.Destination, files)
+	if err != nil {
+		return inputs
+	}
+	inputs.Files, inputs.Digest = files, sum
+	return inputs
+}
 
-	if err := k.Client.Get(); err != nil {
-		return err
+// reuse returns the manifests rendered before the source revision changed when the files they were
+// rendered from are unchanged on the downloaded source
+func (k KustomizerWrapper) reuse(key cache.Key) ([]unstructured.Unstructured, bool) {
+	previous, ok := k.Cache.PreviousInputs(key)
+	if !ok || previous.Digest == "" {
+		return nil, false
+	}
+	sum, err := digest(k.FSys, k.Destination, previous.Files)
+	if err != nil || sum != previous.Digest {
+		return nil, false
+	}
+	manifests, err := k.Cache.Reuse(key, sum)
+	return manifests, err == nil
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// isCacheMiss reports if the error of a cache lookup means the manifests must be rendered again
+func isCacheMiss(err error) bool {
+	return errors.Is(err, cache.ErrNotCached) ||
+		errors.Is(err, cache.ErrModified) ||
+		errors.Is(err, cache.ErrRateLimited) ||
+		errors.Is(err, cache.ErrInvalidSource) ||
+		errors.Is(err, cache.ErrUncacheable)
+}
+
+// CacheKey returns the key under which the manifests rendered by the wrapper are stored on cache
+func (k KustomizerWrapper) CacheKey() cache.Key {
+	return cache.NewKey(k.Source, k.Path, k.optionsFingerprint())
+}
+
+func (k KustomizerWrapper) optionsFingerprint() string {
+	if k.Options == nil {
+		return ""
+	}
+	// krusty options are plain data, marshalling them never fails
+	options, _ := json.Marshal(k.Options)
+	sum := sha256.Sum256(options)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k KustomizerWrapper) getSourceContent(ctx context.Context) error {
+	if client, ok := k.Client.(ContextGetter); ok {
+		return client.GetContext(ctx)
+	}
+	return k.Client.Get()
+}
+
+type destinationLocks struct {
+	mu    sync.Mutex
+	locks map[string]*destinationLock
+}
+
+// destinationLock is held by one render of the destination at a time, users counts the render holding it
+// and the ones waiting for it, so it is removed once no render uses the destination
+type destinationLock struct {
+	held  chan struct{}
+	users int
+}
+
+// lock waits until the destination is free or the context is done
+func (d *destinationLocks) lock(ctx context.Context, destination string) error {
+	d.mu.Lock()
+	lock, ok := d.locks[destination]
+	if !ok {
+		lock = &destinationLock{held: make(chan struct{}, 1)}
+		d.locks[destination] = lock
+	}
+	lock.users++
+	d.mu.Unlock()
+	select {
+	case lock.held <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		d.release(destination)
+		return ctx.Err()
+	}
+}
+
+func (d *destinationLocks) unlock(destination string) {
+	d.mu.Lock()
+	lock := d.locks[destination]
+	d.mu.Unlock()
+	<-lock.held
+	d.release(destination)
+}
+
+// release stops counting a user of the destination, removing its lock when it was the last one
+func (d *destinationLocks) release(destination string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lock := d.locks[destination]
+	lock.users--
+	if lock.users == 0 {
+		delete(d.locks, destination)
 	}
-	return nil
 }
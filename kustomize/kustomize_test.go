@@ -1,8 +1,11 @@
 package kustomize_test
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/dgraph-io/ristretto"
 	. "github.com/onsi/ginkgo"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -13,10 +16,13 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"net/http"
 	"path/filepath"
+	"sigs.k8s.io/kustomize/api/krusty"
 	"sigs.k8s.io/kustomize/api/loader"
 	"sigs.k8s.io/kustomize/api/provider"
 	"sigs.k8s.io/kustomize/api/resmap"
 	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sync/atomic"
+	"time"
 )
 
 var _ = Describe("Kustomize", func() {
@@ -28,9 +34,10 @@ var _ = Describe("Kustomize", func() {
 	var cacheWrapper cache.Wrapper
 	var mockCache *mocksCache.Cache
 	var mockHttp *mocksCache.HttpClient
+	var key string
 	BeforeEach(func() {
 
-		source = "example.com/test"
+		source = "github.com/org/test"
 		destination = "/destination"
 		path = "path"
 		getter = new(mocks.Getter)
@@ -38,12 +45,13 @@ var _ = Describe("Kustomize", func() {
 		mockCache = new(mocksCache.Cache)
 		mockHttp = new(mocksCache.HttpClient)
 		cacheWrapper = cache.New(mockCache, mockHttp)
+		key = cache.NewKey(source, path, "").String()
 	})
 	Context("when fails to download repository content", func() {
 		It("should return error", func() {
-			mockCache.On("Get", source).Return(nil, false)
+			mockCache.On("Get", key).Return(nil, false)
 			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
-			mockCache.On("Set", source, mock.Anything, int64(1)).Times(1).Return(true)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Times(1).Return(true)
 			error := errors.New("failed to download resource")
 
 			getter.On("Get").Return(error)
@@ -61,10 +69,10 @@ var _ = Describe("Kustomize", func() {
 			error := errors.New("failed to render resource")
 
 			getter.On("Get").Return(nil)
-			renderer.On("Run", filesys.MakeFsOnDisk(), filepath.Join(destination, path)).Return(resmap.New(), error)
-			mockCache.On("Get", source).Return(nil, false)
+			renderer.On("Run", recordingFs, filepath.Join(destination, path)).Return(resmap.New(), error)
+			mockCache.On("Get", key).Return(nil, false)
 			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
-			mockCache.On("Set", source, mock.Anything, int64(1)).Times(1).Return(true)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Times(1).Return(true)
 			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
 			manifests, renderError := k.Render()
 			assert.Equal(GinkgoT(), renderError, error)
@@ -76,10 +84,12 @@ var _ = Describe("Kustomize", func() {
 		It("should return the correct unstructured manifests", func() {
 
 			getter.On("Get").Return(nil)
-			renderer.On("Run", filesys.MakeFsOnDisk(), filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
-			mockCache.On("Get", source).Return("123", true)
+			renderer.On("Run", recordingFs, filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "123"}, true)
 			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusModified(), nil)
-			mockCache.On("Set", "123", getManifestsUnstructured(), int64(1)).Times(1).Return(true)
+			mockCache.On("Set", key, cache.Entry{Revision: "123"}, cache.EntryCost(cache.Entry{Revision: "123"})).Times(1).Return(true)
+			entry := withSize(cache.Entry{Revision: "123", Manifests: getManifestsUnstructured()})
+			mockCache.On("Set", key, entry, cache.EntryCost(entry)).Times(1).Return(true)
 			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
 			manifests, renderError := k.Render()
 			assert.Equal(GinkgoT(), renderError, nil)
@@ -94,18 +104,421 @@ var _ = Describe("Kustomize", func() {
 	})
 
 	Context("when fails to add manifests in cache", func() {
-		It("should return error", func() {
+		It("should return the manifests without caching them", func() {
 
 			getter.On("Get").Return(nil)
-			renderer.On("Run", filesys.MakeFsOnDisk(), filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
-			mockCache.On("Get", source).Return("123", true)
+			renderer.On("Run", recordingFs, filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "123"}, true)
 			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusModified(), nil)
-			mockCache.On("Set", "123", getManifestsUnstructured(), int64(1)).Times(1).Return(false)
+			mockCache.On("Set", key, cache.Entry{Revision: "123"}, cache.EntryCost(cache.Entry{Revision: "123"})).Times(1).Return(true)
+			entry := withSize(cache.Entry{Revision: "123", Manifests: getManifestsUnstructured()})
+			mockCache.On("Set", key, entry, cache.EntryCost(entry)).Times(1).Return(false)
+			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
+			manifests, renderError := k.Render()
+			assert.NoError(GinkgoT(), renderError)
+			assert.Equal(GinkgoT(), getManifestsUnstructured(), manifests)
+
+		})
+	})
+
+	Context("when the wrapper has renderer options", func() {
+		It("should store the manifests apart from renders with other options", func() {
 			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
+			withoutOptions := k.CacheKey()
+			k.Options = krusty.MakeDefaultOptions()
+			withOptions := k.CacheKey()
+			assert.Equal(GinkgoT(), withoutOptions.String(), key)
+			assert.NotEqual(GinkgoT(), withOptions.String(), withoutOptions.String())
+			assert.Equal(GinkgoT(), withOptions.Path, path)
+		})
+	})
+
+	Context("when fails to check the source revision", func() {
+		It("should return the upstream error without downloading the source", func() {
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "123", Manifests: getManifestsUnstructured()}, true)
+			mockHttp.On("Do", mock.Anything).Return(nil, errors.New("connection refused"))
+
+			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
+			manifests, renderError := k.Render()
+			assert.ErrorIs(GinkgoT(), renderError, cache.ErrUpstream)
+			assert.Equal(GinkgoT(), len(manifests), 0)
+			getter.AssertNotCalled(GinkgoT(), "Get")
+		})
+	})
+
+	Context("when the source host refuses the credentials", func() {
+		It("should return the error without rendering", func() {
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatus(http.StatusUnauthorized), nil)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "123", Manifests: getManifestsUnstructured()}, true)
+
+			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
+			manifests, renderError := k.Render()
+			assert.ErrorIs(GinkgoT(), renderError, cache.ErrUnauthorized)
+			assert.Equal(GinkgoT(), len(manifests), 0)
+			getter.AssertNotCalled(GinkgoT(), "Get")
+		})
+	})
+
+	Context("when the source revision can't be validated", func() {
+		It("should render the manifests without caching them", func() {
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatus(http.StatusNotFound), nil)
+			getter.On("Get").Return(nil)
+			renderer.On("Run", filesys.MakeFsOnDisk(), filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "123", Manifests: getManifestsUnstructured()}, true)
+
+			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
+			manifests, renderError := k.Render()
+			assert.NoError(GinkgoT(), renderError)
+			assert.Equal(GinkgoT(), getManifestsUnstructured(), manifests)
+			mockCache.AssertNotCalled(GinkgoT(), "Set", mock.Anything, mock.Anything, mock.Anything)
+		})
+	})
+
+	Context("when the source host has no revision provider", func() {
+		It("should render the manifests without caching them", func() {
+			getter.On("Get").Return(nil)
+			renderer.On("Run", filesys.MakeFsOnDisk(), filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
+
+			k := kustomize.New(renderer, getter, destination, "bitbucket.org/org/test", path, cacheWrapper)
 			manifests, renderError := k.Render()
-			assert.Equal(GinkgoT(), renderError, errors.New("failed to set manifests to cache"))
+			assert.NoError(GinkgoT(), renderError)
+			assert.Equal(GinkgoT(), getManifestsUnstructured(), manifests)
+			mockHttp.AssertNotCalled(GinkgoT(), "Do", mock.Anything)
+			mockCache.AssertNotCalled(GinkgoT(), "Set", mock.Anything, mock.Anything, mock.Anything)
+		})
+	})
+
+	Context("when fails to check the source revision and the cache serves stale manifests", func() {
+		It("should return the cached manifests marked as stale without downloading the source", func() {
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "123", Manifests: getManifestsUnstructured()}, true)
+			mockHttp.On("Do", mock.Anything).Return(nil, errors.New("connection refused"))
+
+			k := kustomize.New(renderer, getter, destination, source, path, cache.New(mockCache, mockHttp, cache.WithStaleIfError()))
+			result, renderError := k.RenderResult(context.Background())
+			assert.Equal(GinkgoT(), renderError, nil)
+			assert.True(GinkgoT(), result.Stale)
+			assert.ErrorIs(GinkgoT(), result.Err, cache.ErrUpstream)
+			assert.Equal(GinkgoT(), len(result.Manifests), len(getManifestsUnstructured()))
+			getter.AssertNotCalled(GinkgoT(), "Get")
+		})
+	})
+
+	Context("when the source can't be validated by the cache", func() {
+		It("should render the manifests without caching them", func() {
+			getter.On("Get").Return(nil)
+			renderer.On("Run", filesys.MakeFsOnDisk(), filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
+
+			k := kustomize.New(renderer, getter, destination, "./manifests", path, cacheWrapper)
+			manifests, renderError := k.Render()
+			assert.Equal(GinkgoT(), renderError, nil)
+			assert.Equal(GinkgoT(), len(manifests), 2)
+			mockCache.AssertNotCalled(GinkgoT(), "Get", mock.Anything)
+			mockCache.AssertNotCalled(GinkgoT(), "Set", mock.Anything, mock.Anything, mock.Anything)
+		})
+	})
+
+	Context("when the download takes longer than the context deadline", func() {
+		It("should return the context error", func() {
+			mockCache.On("Get", key).Return(nil, false)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Times(1).Return(true)
+			getter.On("Get").After(time.Second).Return(nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
+			manifests, renderError := k.RenderContext(ctx)
+			assert.ErrorIs(GinkgoT(), renderError, context.DeadlineExceeded)
 			assert.Equal(GinkgoT(), len(manifests), 0)
+			renderer.AssertNotCalled(GinkgoT(), "Run", mock.Anything, mock.Anything)
+		})
+	})
+
+	Context("when the client is a context getter", func() {
+		It("should pass the render context to the download", func() {
+			contextGetter := new(mocks.ContextGetter)
+			ctx := context.WithValue(context.Background(), renderContextKey{}, "render")
+			error := errors.New("failed to download resource")
+			mockCache.On("Get", key).Return(nil, false)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Times(1).Return(true)
+			contextGetter.On("GetContext", ctx).Return(error)
+
+			k := kustomize.New(renderer, contextGetter, destination, source, path, cacheWrapper)
+			_, renderError := k.RenderContext(ctx)
+			assert.Equal(GinkgoT(), renderError, error)
+			contextGetter.AssertNotCalled(GinkgoT(), "Get")
+		})
+	})
 
+	Context("when the render takes longer than the context deadline", func() {
+		It("should return the context error", func() {
+			mockCache.On("Get", key).Return(nil, false)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Times(1).Return(true)
+			getter.On("Get").Return(nil)
+			renderer.On("Run", recordingFs, filepath.Join(destination, path)).After(time.Second).Return(getManifestsResponseMap(), nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
+			manifests, renderError := k.RenderContext(ctx)
+			assert.ErrorIs(GinkgoT(), renderError, context.DeadlineExceeded)
+			assert.Equal(GinkgoT(), len(manifests), 0)
+		})
+	})
+
+	Context("when several renders of the same source run at once", func() {
+		It("should download and render the source only once", func() {
+			getter.On("Get").After(100 * time.Millisecond).Return(nil).Once()
+			renderer.On("Run", recordingFs, filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil).Once()
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "dummy-etag"}, true)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Return(true)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+
+			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
+			results := make(chan []unstructured.Unstructured, 5)
+			for i := 0; i < 5; i++ {
+				go func() {
+					manifests, renderError := k.Render()
+					assert.NoError(GinkgoT(), renderError)
+					results <- manifests
+				}()
+			}
+			for i := 0; i < 5; i++ {
+				assert.Equal(GinkgoT(), len(<-results), 2)
+			}
+			getter.AssertNumberOfCalls(GinkgoT(), "Get", 1)
+			renderer.AssertNumberOfCalls(GinkgoT(), "Run", 1)
+		})
+	})
+
+	Context("when renders of the same source to different destinations run at once", func() {
+		It("should download and render the source to each destination", func() {
+			getter.On("Get").After(100 * time.Millisecond).Return(nil)
+			renderer.On("Run", recordingFs, mock.Anything).Return(getManifestsResponseMap(), nil)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "dummy-etag"}, true)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Return(true)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+
+			results := make(chan error, 2)
+			for _, dir := range []string{destination, destination + "-other"} {
+				k := kustomize.New(renderer, getter, dir, source, path, cacheWrapper)
+				go func() {
+					_, renderError := k.Render()
+					results <- renderError
+				}()
+			}
+			assert.NoError(GinkgoT(), <-results)
+			assert.NoError(GinkgoT(), <-results)
+			getter.AssertNumberOfCalls(GinkgoT(), "Get", 2)
+			renderer.AssertCalled(GinkgoT(), "Run", recordingFs, filepath.Join(destination+"-other", path))
+		})
+
+		It("should run a serial renderer one build at a time", func() {
+			overlap := &overlapRenderer{delay: 50 * time.Millisecond}
+			getter.On("Get").Return(nil)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "dummy-etag"}, true)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Return(true)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+
+			results := make(chan error, 2)
+			for _, dir := range []string{destination, destination + "-other"} {
+				k := kustomize.New(kustomize.SerialRenderer{Renderer: overlap}, getter, dir, source, path, cacheWrapper)
+				go func() {
+					_, renderError := k.Render()
+					results <- renderError
+				}()
+			}
+			assert.NoError(GinkgoT(), <-results)
+			assert.NoError(GinkgoT(), <-results)
+			assert.Equal(GinkgoT(), int32(2), atomic.LoadInt32(&overlap.calls))
+			assert.Equal(GinkgoT(), int32(1), atomic.LoadInt32(&overlap.maxActive))
+		})
+	})
+
+	Context("when renders to temporary destinations are done", func() {
+		It("should not keep the locks of the destinations", func() {
+			getter.On("Get").Return(nil)
+			renderer.On("Run", recordingFs, mock.Anything).Return(getManifestsResponseMap(), nil)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "dummy-etag"}, true)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Return(true)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+			for i := 0; i < 3; i++ {
+				k := kustomize.New(renderer, getter, fmt.Sprintf("%s-%d", destination, i), source, path, cacheWrapper)
+				_, renderError := k.Render()
+				assert.NoError(GinkgoT(), renderError)
+			}
+			assert.Equal(GinkgoT(), 0, kustomize.LockedDestinations())
+		})
+
+		It("should not keep the lock of a destination whose render gave up waiting for it", func() {
+			overlap := &overlapGetter{delay: 100 * time.Millisecond}
+			renderer.On("Run", recordingFs, filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
+			mockCache.On("Get", mock.Anything).Return(cache.Entry{Revision: "dummy-etag"}, true)
+			mockCache.On("Set", mock.Anything, mock.Anything, mock.Anything).Return(true)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+			rendered := make(chan error, 1)
+			go func() {
+				_, renderError := kustomize.New(renderer, overlap, destination, source, path, cacheWrapper).Render()
+				rendered <- renderError
+			}()
+			assert.Eventually(GinkgoT(), func() bool {
+				return atomic.LoadInt32(&overlap.calls) == 1
+			}, time.Second, time.Millisecond)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, renderError := kustomize.New(renderer, overlap, destination, source, "overlays/other", cacheWrapper).RenderContext(ctx)
+			assert.ErrorIs(GinkgoT(), renderError, context.DeadlineExceeded)
+			assert.NoError(GinkgoT(), <-rendered)
+			assert.Equal(GinkgoT(), 0, kustomize.LockedDestinations())
+		})
+	})
+
+	Context("when the renderer panics", func() {
+		It("should return the panic as an error and free the destination", func() {
+			getter.On("Get").Return(nil)
+			renderer.On("Run", recordingFs, filepath.Join(destination, path)).Run(func(mock.Arguments) {
+				panic("malformed kustomization")
+			}).Return(resmap.New(), nil).Once()
+			renderer.On("Run", recordingFs, filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "dummy-etag"}, true)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Return(true)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
+			_, renderError := k.Render()
+			assert.EqualError(GinkgoT(), renderError, "panic rendering "+filepath.Join(destination, path)+": malformed kustomization")
+			manifests, renderError := k.Render()
+			assert.NoError(GinkgoT(), renderError)
+			assert.Len(GinkgoT(), manifests, 2)
+		})
+	})
+
+	Context("when a render is abandoned while downloading the source", func() {
+		It("should wait for the download before downloading to the destination again", func() {
+			overlap := &overlapGetter{delay: 200 * time.Millisecond}
+			renderer.On("Run", recordingFs, filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: "dummy-etag"}, true)
+			mockCache.On("Set", key, mock.Anything, mock.Anything).Return(true)
+			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			k := kustomize.New(renderer, overlap, destination, source, path, cacheWrapper)
+			_, renderError := k.RenderContext(ctx)
+			assert.ErrorIs(GinkgoT(), renderError, context.DeadlineExceeded)
+			_, renderError = k.Render()
+			assert.NoError(GinkgoT(), renderError)
+			assert.Equal(GinkgoT(), int32(2), atomic.LoadInt32(&overlap.calls))
+			assert.Equal(GinkgoT(), int32(1), atomic.LoadInt32(&overlap.maxActive))
+		})
+	})
+
+	Context("when the cache scopes revisions to paths", func() {
+		It("should add the manifests with the directories the render read", func() {
+			fSys := filesys.MakeFsInMemory()
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/base/kustomization.yaml", []byte("resources:\n- deployment.yaml\n")))
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/base/deployment.yaml", []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: deploy1\n")))
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/overlays/dev/kustomization.yaml", []byte("resources:\n- ../../base\nnamePrefix: dev-\n")))
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/overlays/prod/kustomization.yaml", []byte("resources:\n- ../../base\n")))
+			provider := new(mocksCache.PathRevisionProvider)
+			provider.On("Revision", mock.Anything, mock.Anything, mock.Anything).Return("etag", nil)
+			scoped := cache.New(mockCache, mockHttp, cache.WithRevisionProvider("github.com", provider), cache.WithPathScopedRevisions())
+			devKey := cache.NewKey(source, "overlays/dev", "").String()
+			mockCache.On("Get", devKey).Return(cache.Entry{Revision: "etag"}, true)
+			mockCache.On("Set", devKey, mock.Anything, mock.Anything).Return(true)
+			getter.On("Get").Return(nil)
+
+			k := kustomize.New(krusty.MakeKustomizer(krusty.MakeDefaultOptions()), getter, "/repo", source, "overlays/dev", scoped)
+			k.FSys = fSys
+			manifests, renderError := k.Render()
+			assert.NoError(GinkgoT(), renderError)
+			assert.Equal(GinkgoT(), 1, len(manifests))
+			assert.Equal(GinkgoT(), "dev-deploy1", manifests[0].GetName())
+			provider.AssertExpectations(GinkgoT())
+			mockCache.AssertCalled(GinkgoT(), "Set", devKey, mock.MatchedBy(func(entry cache.Entry) bool {
+				return entry.Revision == "etag" && assert.ObjectsAreEqual([]string{"base", "overlays/dev"}, entry.Paths)
+			}), mock.Anything)
+			provider.AssertNotCalled(GinkgoT(), "PathRevision", mock.Anything, mock.Anything, mock.Anything)
+		})
+	})
+
+	Context("when the source changes but the files of the render are unchanged", func() {
+		It("should reuse the cached manifests without running the renderer", func() {
+			ristrettoCache, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e4, MaxCost: 1 << 20, BufferItems: 64})
+			assert.NoError(GinkgoT(), err)
+			defer ristrettoCache.Close()
+			var revisions int32
+			provider := new(mocksCache.RevisionProvider)
+			provider.On("Revision", mock.Anything, mock.Anything, mock.Anything).Return(func(context.Context, cache.Key, string) string {
+				return fmt.Sprintf("etag-%d", atomic.AddInt32(&revisions, 1))
+			}, nil)
+			fSys := filesys.MakeFsInMemory()
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/base/kustomization.yaml", []byte("resources:\n- deployment.yaml\n")))
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/base/deployment.yaml", []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: deploy1\n")))
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/overlays/dev/kustomization.yaml", []byte("resources:\n- ../../base\n")))
+			getter.On("Get").Return(nil)
+			counter := &countingRenderer{Renderer: krusty.MakeKustomizer(krusty.MakeDefaultOptions())}
+
+			k := kustomize.New(counter, getter, "/repo", source, "overlays/dev", cache.New(ristrettoCache, mockHttp, cache.WithRevisionProvider("github.com", provider)))
+			k.FSys = fSys
+			k.ReuseUnchanged = true
+			first, renderError := k.Render()
+			assert.NoError(GinkgoT(), renderError)
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/README.md", []byte("changed")))
+			second, renderError := k.Render()
+			assert.NoError(GinkgoT(), renderError)
+			assert.Equal(GinkgoT(), first, second)
+			assert.Equal(GinkgoT(), int32(1), atomic.LoadInt32(&counter.runs))
+
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/base/deployment.yaml", []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: deploy2\n")))
+			third, renderError := k.Render()
+			assert.NoError(GinkgoT(), renderError)
+			assert.Equal(GinkgoT(), "deploy2", third[0].GetName())
+			assert.Equal(GinkgoT(), int32(2), atomic.LoadInt32(&counter.runs))
+		})
+	})
+
+	Context("when the kustomizations reference remote bases", func() {
+		It("should add the manifests with the revisions of the remote bases", func() {
+			fSys := filesys.MakeFsInMemory()
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/overlays/dev/kustomization.yaml", []byte(
+				"resources:\n- ../../base\n- github.com/org/shared/base?ref=main\n- https://gitlab.com/group/sub/repo.git/apps/web?ref=v1\n")))
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/base/kustomization.yaml", []byte("resources:\n- deployment.yaml\n")))
+			assert.NoError(GinkgoT(), fSys.WriteFile("/tmp/clone/base/kustomization.yaml", []byte("bases:\n- git::https://github.com/org/common.git//config?ref=v2\n")))
+			provider := new(mocksCache.RevisionProvider)
+			provider.On("Revision", mock.Anything, mock.Anything, mock.Anything).Return(func(_ context.Context, key cache.Key, _ string) string {
+				return "etag-" + key.Source
+			}, nil)
+			renderer.On("Run", mock.Anything, "/repo/overlays/dev").Run(func(args mock.Arguments) {
+				reader := args.Get(0).(filesys.FileSystem)
+				_, err := reader.ReadFile("/repo/overlays/dev/kustomization.yaml")
+				assert.NoError(GinkgoT(), err)
+				// the remotes of a kustomization are resolved when it is read, before they are cloned
+				provider.AssertCalled(GinkgoT(), "Revision", mock.Anything, cache.NewKey("github.com/org/shared//base?ref=main", "", ""), "")
+				for _, file := range []string{"/repo/base/kustomization.yaml", "/tmp/clone/base/kustomization.yaml"} {
+					_, err := reader.ReadFile(file)
+					assert.NoError(GinkgoT(), err)
+				}
+			}).Return(getManifestsResponseMap(), nil)
+			devKey := cache.NewKey(source, "overlays/dev", "").String()
+			mockCache.On("Get", devKey).Return(cache.Entry{Revision: "etag"}, true)
+			mockCache.On("Set", devKey, mock.Anything, mock.Anything).Return(true)
+			getter.On("Get").Return(nil)
+
+			remotesCache := cache.New(mockCache, mockHttp, cache.WithDefaultRevisionProvider(provider),
+				cache.WithRevisionProvider("github.com", provider), cache.WithRevisionProvider("gitlab.com", provider))
+			k := kustomize.New(renderer, getter, "/repo", source, "overlays/dev", remotesCache)
+			k.FSys = fSys
+			_, renderError := k.Render()
+			assert.NoError(GinkgoT(), renderError)
+			mockCache.AssertCalled(GinkgoT(), "Set", devKey, mock.MatchedBy(func(entry cache.Entry) bool {
+				return assert.ObjectsAreEqual(map[string]string{
+					"github.com/org/shared//base?ref=main":                   "etag-github.com/org/shared",
+					"https://gitlab.com/group/sub/repo.git//apps/web?ref=v1": "etag-https://gitlab.com/group/sub/repo.git",
+					"git::https://github.com/org/common.git//config?ref=v2":  "etag-git::https://github.com/org/common.git",
+				}, entry.Remotes)
+			}), mock.Anything)
 		})
 	})
 
@@ -114,9 +527,8 @@ var _ = Describe("Kustomize", func() {
 			etag := "dummy-etag"
 			getter.On("Get").Return(nil)
 			renderer.On("Run", filesys.MakeFsOnDisk(), filepath.Join(destination, path)).Return(getManifestsResponseMap(), nil)
-			mockCache.On("Get", source).Return(etag, true)
+			mockCache.On("Get", key).Return(cache.Entry{Revision: etag, Manifests: getManifestsUnstructured()}, true)
 			mockHttp.On("Do", mock.Anything).Return(GetHTTPResponseWithStatusNotModified(), nil)
-			mockCache.On("Get", etag).Times(1).Return(getManifestsUnstructured(), true)
 			k := kustomize.New(renderer, getter, destination, source, path, cacheWrapper)
 			manifests, renderError := k.Render()
 			assert.Equal(GinkgoT(), renderError, nil)
@@ -135,6 +547,22 @@ var _ = Describe("Kustomize", func() {
 
 })
 
+type renderContextKey struct{}
+
+// recordingFs matches the file system cached renders run on, which records the files the renderer reads
+var recordingFs = mock.AnythingOfType("*kustomize.readRecorder")
+
+// countingRenderer counts the runs of the renderer it wraps
+type countingRenderer struct {
+	kustomize.Renderer
+	runs int32
+}
+
+func (r *countingRenderer) Run(fSys filesys.FileSystem, path string) (resmap.ResMap, error) {
+	atomic.AddInt32(&r.runs, 1)
+	return r.Renderer.Run(fSys, path)
+}
+
 func getManifestsResponseMap() resmap.ResMap {
 	var depProvider = provider.NewDefaultDepProvider()
 	var rf = depProvider.GetResourceFactory()
@@ -176,6 +604,15 @@ func GetHTTPResponseWithStatusModified() *http.Response {
 	response.StatusCode = http.StatusOK
 	return response
 }
+
+// withSize returns the entry with the Size the cache computes when it stores the manifests
+func withSize(entry cache.Entry) cache.Entry {
+	manifests, err := json.Marshal(entry.Manifests)
+	assert.NoError(GinkgoT(), err)
+	entry.Size = int64(len(manifests))
+	return entry
+}
+
 func getManifestsUnstructured() []unstructured.Unstructured {
 	var unstructuredManifest []unstructured.Unstructured
 	resMap := getManifestsResponseMap()
@@ -185,3 +622,54 @@ func getManifestsUnstructured() []unstructured.Unstructured {
 	assert.NoError(GinkgoT(), err)
 	return unstructuredManifest
 }
+
+func GetHTTPResponseWithStatus(status int) *http.Response {
+	response := new(http.Response)
+	response.Header = make(map[string][]string)
+	response.StatusCode = status
+	return response
+}
+
+// overlapGetter records the most downloads running at once
+type overlapGetter struct {
+	delay     time.Duration
+	calls     int32
+	active    int32
+	maxActive int32
+}
+
+func (g *overlapGetter) Get() error {
+	atomic.AddInt32(&g.calls, 1)
+	active := atomic.AddInt32(&g.active, 1)
+	defer atomic.AddInt32(&g.active, -1)
+	for {
+		max := atomic.LoadInt32(&g.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(&g.maxActive, max, active) {
+			break
+		}
+	}
+	time.Sleep(g.delay)
+	return nil
+}
+
+// overlapRenderer records the most runs overlapping in time
+type overlapRenderer struct {
+	delay     time.Duration
+	calls     int32
+	active    int32
+	maxActive int32
+}
+
+func (r *overlapRenderer) Run(filesys.FileSystem, string) (resmap.ResMap, error) {
+	atomic.AddInt32(&r.calls, 1)
+	active := atomic.AddInt32(&r.active, 1)
+	defer atomic.AddInt32(&r.active, -1)
+	for {
+		max := atomic.LoadInt32(&r.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(&r.maxActive, max, active) {
+			break
+		}
+	}
+	time.Sleep(r.delay)
+	return getManifestsResponseMap(), nil
+}
@@ -0,0 +1,200 @@
+package kustomize
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// readRecorder is a filesys.FileSystem recording the files the renderer reads, so the revision of the
+// manifests can be scoped to the paths of the source they were rendered from and the manifests can be
+// reused while those files are unchanged
+type readRecorder struct {
+	filesys.FileSystem
+	// resolve returns the revision of a remote source, it is called when a kustomization listing the remote
+	// is read, before the renderer clones it, so the revision is the one of the clone or older
+	resolve func(source string) string
+	mu      sync.Mutex
+	files   []string
+	// revisions are the revisions of the remote sources listed by the kustomizations read
+	revisions map[string]string
+}
+
+func (r *readRecorder) ReadFile(path string) ([]byte, error) {
+	r.record(path)
+	content, err := r.FileSystem.ReadFile(path)
+	if err == nil && isKustomizationFile(path) {
+		for _, source := range r.kustomizationRemotes(path, content) {
+			r.resolveRemote(source)
+		}
+	}
+	return content, err
+}
+
+// resolveRemote fetches the revision of the remote source the first time a kustomization lists it
+func (r *readRecorder) resolveRemote(source string) {
+	r.mu.Lock()
+	_, resolved := r.revisions[source]
+	if !resolved {
+		if r.revisions == nil {
+			r.revisions = map[string]string{}
+		}
+		r.revisions[source] = ""
+	}
+	r.mu.Unlock()
+	if resolved || r.resolve == nil {
+		return
+	}
+	revision := r.resolve(source)
+	r.mu.Lock()
+	r.revisions[source] = revision
+	r.mu.Unlock()
+}
+
+func (r *readRecorder) Open(path string) (filesys.File, error) {
+	r.record(path)
+	return r.FileSystem.Open(path)
+}
+
+func (r *readRecorder) record(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files = append(r.files, path)
+}
+
+// dirs returns the directories of the files read inside root relative to it, without the ones nested
+// in another returned directory. Files outside root, like remote bases, are left out
+func (r *readRecorder) dirs(root string) []string {
+	files, _ := r.relative(root)
+	seen := map[string]bool{}
+	var dirs []string
+	for _, file := range files {
+		dir := path.Dir(file)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	var minimal []string
+	for _, dir := range dirs {
+		if !nestedInAny(dir, minimal) {
+			minimal = append(minimal, dir)
+		}
+	}
+	return minimal
+}
+
+// relative returns the sorted files read inside root relative to it, reporting false when files outside
+// root were read too
+func (r *readRecorder) relative(root string) ([]string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, false
+	}
+	inside := true
+	seen := map[string]bool{}
+	var files []string
+	for _, file := range r.files {
+		file, err := filepath.Abs(file)
+		if err != nil {
+			inside = false
+			continue
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			inside = false
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if !seen[rel] {
+			seen[rel] = true
+			files = append(files, rel)
+		}
+	}
+	sort.Strings(files)
+	return files, inside
+}
+
+// remotes returns the revisions of the remote bases, resources and components of the kustomizations read by
+// their source, including the ones of remote kustomizations. Revisions that couldn't be fetched are empty
+func (r *readRecorder) remotes() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.revisions) == 0 {
+		return nil
+	}
+	remotes := make(map[string]string, len(r.revisions))
+	for source, revision := range r.revisions {
+		remotes[source] = revision
+	}
+	return remotes
+}
+
+// kustomizationRemotes returns the sources of the remote entries of the kustomization file
+func (r *readRecorder) kustomizationRemotes(file string, content []byte) []string {
+	var kustomization struct {
+		Resources  []string `json:"resources"`
+		Bases      []string `json:"bases"`
+		Components []string `json:"components"`
+	}
+	if err := yaml.Unmarshal(content, &kustomization); err != nil {
+		return nil
+	}
+	var remotes []string
+	entries := append(append(kustomization.Resources, kustomization.Bases...), kustomization.Components...)
+	for _, entry := range entries {
+		if r.FileSystem.Exists(filepath.Join(filepath.Dir(file), entry)) {
+			continue
+		}
+		if source, ok := remoteSource(entry); ok {
+			remotes = append(remotes, source)
+		}
+	}
+	return remotes
+}
+
+// digest hashes the path and content of the files relative to root, it fails when a file can't be read
+func digest(fSys filesys.FileSystem, root string, files []string) (string, error) {
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+	hash := sha256.New()
+	for _, file := range sorted {
+		content, err := fSys.ReadFile(filepath.Join(root, filepath.FromSlash(file)))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", file, len(content))
+		hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// nestedInAny reports if dir is one of the parents or inside one of them
+func nestedInAny(dir string, parents []string) bool {
+	for _, parent := range parents {
+		if parent == "." || dir == parent || strings.HasPrefix(dir, parent+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func isKustomizationFile(file string) bool {
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if filepath.Base(file) == name {
+			return true
+		}
+	}
+	return false
+}
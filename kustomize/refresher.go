@@ -0,0 +1,131 @@
+package kustomize
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Refresher keeps the manifests of the registered wrappers warm, checking their sources on an interval and
+// rendering the changed ones ahead of time, so requests find them on cache instead of paying the render.
+// The revisions are checked in parallel, while the renders of wrappers sharing a destination happen one at a time
+type Refresher struct {
+	interval    time.Duration
+	jitter      float64
+	concurrency int
+	onError     func(k KustomizerWrapper, err error)
+	mu          sync.Mutex
+	wrappers    []KustomizerWrapper
+	// random spreads the intervals, it is seeded for each refresher so replicas don't share the sequence
+	random *rand.Rand
+}
+
+// RefresherOption configures a Refresher
+type RefresherOption func(*Refresher)
+
+// WithJitter spreads the refreshes by randomly shortening or stretching each interval by up to the fraction
+// of it, so replicas started together don't check the sources at once. It must be in [0, 1), 0.1 by default
+func WithJitter(fraction float64) RefresherOption {
+	return func(r *Refresher) {
+		r.jitter = fraction
+	}
+}
+
+// WithConcurrency bounds the wrappers refreshed at once, 4 by default
+func WithConcurrency(concurrency int) RefresherOption {
+	return func(r *Refresher) {
+		r.concurrency = concurrency
+	}
+}
+
+// WithRefreshErrorHandler calls onError with the wrappers that failed to refresh and their errors
+func WithRefreshErrorHandler(onError func(k KustomizerWrapper, err error)) RefresherOption {
+	return func(r *Refresher) {
+		r.onError = onError
+	}
+}
+
+// NewRefresher instantiates a refresher of the wrappers every interval, which must be positive
+func NewRefresher(interval time.Duration, wrappers []KustomizerWrapper, options ...RefresherOption) (*Refresher, error) {
+	r := &Refresher{
+		interval:    interval,
+		jitter:      0.1,
+		concurrency: 4,
+		wrappers:    append([]KustomizerWrapper(nil), wrappers...),
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, option := range options {
+		option(r)
+	}
+	if r.interval <= 0 {
+		return nil, errors.New("refresh interval must be positive")
+	}
+	if r.jitter < 0 || r.jitter >= 1 {
+		return nil, errors.New("refresh jitter must be in [0, 1)")
+	}
+	if r.concurrency < 1 {
+		r.concurrency = 1
+	}
+	return r, nil
+}
+
+// Register adds wrappers to be refreshed from the next refresh on, it is safe to call while the refresher runs
+func (r *Refresher) Register(wrappers ...KustomizerWrapper) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wrappers = append(r.wrappers, wrappers...)
+}
+
+// Run refreshes the wrappers right away and then on every interval until the context is done,
+// it returns once the refreshes in flight are done
+func (r *Refresher) Run(ctx context.Context) {
+	for {
+		r.Refresh(ctx)
+		timer := time.NewTimer(r.next())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Refresh renders the wrappers whose sources changed, refreshing at most the concurrency of the refresher at once.
+// Wrappers whose sources are unchanged only have their revision checked, their manifests aren't copied
+func (r *Refresher) Refresh(ctx context.Context) {
+	r.mu.Lock()
+	wrappers := append([]KustomizerWrapper(nil), r.wrappers...)
+	r.mu.Unlock()
+	slots := make(chan struct{}, r.concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, k := range wrappers {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(k KustomizerWrapper) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := k.Refresh(ctx)
+			if err != nil && ctx.Err() == nil && r.onError != nil {
+				r.onError(k, err)
+			}
+		}(k)
+	}
+}
+
+// next returns the interval until the next refresh, spread by the jitter. It is only called by Run,
+// so the random source isn't shared between goroutines
+func (r *Refresher) next() time.Duration {
+	if r.jitter == 0 {
+		return r.interval
+	}
+	spread := (r.random.Float64()*2 - 1) * r.jitter
+	return time.Duration(float64(r.interval) * (1 + spread))
+}
@@ -0,0 +1,174 @@
+package kustomize_test
+
+import (
+	"context"
+	"errors"
+	"github.com/dgraph-io/ristretto"
+	. "github.com/onsi/ginkgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	mocksCache "github.com/thallesfreitaszup/lib-kustomize/cache/mocks"
+	"github.com/thallesfreitaszup/lib-kustomize/kustomize"
+	"github.com/thallesfreitaszup/lib-kustomize/kustomize/mocks"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Refresher", func() {
+	var ristrettoCache *ristretto.Cache
+	var revision atomic.Value
+	var manifestCache cache.Wrapper
+	var fSys filesys.FileSystem
+	var getter *mocks.Getter
+	BeforeEach(func() {
+		var err error
+		ristrettoCache, err = ristretto.NewCache(&ristretto.Config{NumCounters: 1e4, MaxCost: 1 << 20, BufferItems: 64})
+		assert.NoError(GinkgoT(), err)
+		revision.Store("v1")
+		provider := new(mocksCache.RevisionProvider)
+		provider.On("Revision", mock.Anything, mock.Anything, mock.Anything).Return(func(context.Context, cache.Key, string) string {
+			return revision.Load().(string)
+		}, nil)
+		manifestCache = cache.New(ristrettoCache, new(mocksCache.HttpClient), cache.WithDefaultRevisionProvider(provider))
+		fSys = filesys.MakeFsInMemory()
+		for _, overlay := range []string{"dev", "prod", "qa"} {
+			assert.NoError(GinkgoT(), fSys.WriteFile("/repo/overlays/"+overlay+"/kustomization.yaml", []byte("resources:\n- ../../base\nnamePrefix: "+overlay+"-\n")))
+		}
+		assert.NoError(GinkgoT(), fSys.WriteFile("/repo/base/kustomization.yaml", []byte("resources:\n- deployment.yaml\n")))
+		assert.NoError(GinkgoT(), fSys.WriteFile("/repo/base/deployment.yaml", []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: deploy1\n")))
+		getter = new(mocks.Getter)
+		getter.On("Get").Return(nil)
+	})
+	AfterEach(func() {
+		ristrettoCache.Close()
+	})
+
+	wrapper := func(renderer kustomize.Renderer, overlay string) kustomize.KustomizerWrapper {
+		k := kustomize.New(renderer, getter, "/repo", "example.com/org/refreshed", "overlays/"+overlay, manifestCache)
+		k.FSys = fSys
+		return k
+	}
+
+	Context("when the sources are refreshed", func() {
+		It("should render only the changed ones ahead of the requests", func() {
+			counter := &countingRenderer{Renderer: krusty.MakeKustomizer(krusty.MakeDefaultOptions())}
+			dev, prod := wrapper(counter, "dev"), wrapper(counter, "prod")
+			refresher, err := kustomize.NewRefresher(time.Minute, []kustomize.KustomizerWrapper{dev, prod})
+			assert.NoError(GinkgoT(), err)
+
+			refresher.Refresh(context.Background())
+			assert.Equal(GinkgoT(), int32(2), atomic.LoadInt32(&counter.runs))
+			refresher.Refresh(context.Background())
+			assert.Equal(GinkgoT(), int32(2), atomic.LoadInt32(&counter.runs))
+
+			revision.Store("v2")
+			refresher.Refresh(context.Background())
+			assert.Equal(GinkgoT(), int32(4), atomic.LoadInt32(&counter.runs))
+			manifests, err := dev.Render()
+			assert.NoError(GinkgoT(), err)
+			assert.Equal(GinkgoT(), "dev-deploy1", manifests[0].GetName())
+			assert.Equal(GinkgoT(), int32(4), atomic.LoadInt32(&counter.runs))
+		})
+
+		It("should check the revisions of the wrappers in parallel up to its concurrency", func() {
+			renderer := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+			wrappers := []kustomize.KustomizerWrapper{wrapper(renderer, "dev"), wrapper(renderer, "prod"), wrapper(renderer, "qa")}
+			refresher, err := kustomize.NewRefresher(time.Minute, wrappers, kustomize.WithConcurrency(2))
+			assert.NoError(GinkgoT(), err)
+			refresher.Refresh(context.Background())
+
+			provider := &concurrencyProvider{revision: "v1"}
+			for i := range wrappers {
+				wrappers[i].Cache = cache.New(ristrettoCache, new(mocksCache.HttpClient), cache.WithDefaultRevisionProvider(provider))
+			}
+			refresher, err = kustomize.NewRefresher(time.Minute, wrappers, kustomize.WithConcurrency(2))
+			assert.NoError(GinkgoT(), err)
+			refresher.Refresh(context.Background())
+			assert.Equal(GinkgoT(), 3, provider.checks)
+			assert.Equal(GinkgoT(), 2, provider.max)
+		})
+
+		It("should report the wrappers that failed to refresh", func() {
+			failing := new(mocks.Renderer)
+			failing.On("Run", mock.Anything, mock.Anything).Return(resmap.New(), errors.New("invalid kustomization"))
+			failed := make(chan kustomize.KustomizerWrapper, 1)
+			refresher, err := kustomize.NewRefresher(time.Minute, []kustomize.KustomizerWrapper{wrapper(failing, "dev")},
+				kustomize.WithRefreshErrorHandler(func(k kustomize.KustomizerWrapper, err error) {
+					assert.EqualError(GinkgoT(), err, "invalid kustomization")
+					failed <- k
+				}))
+			assert.NoError(GinkgoT(), err)
+			refresher.Refresh(context.Background())
+			assert.Equal(GinkgoT(), "overlays/dev", (<-failed).Path)
+		})
+	})
+
+	Context("when the refresher is misconfigured", func() {
+		It("should return an error", func() {
+			_, err := kustomize.NewRefresher(0, nil)
+			assert.EqualError(GinkgoT(), err, "refresh interval must be positive")
+			_, err = kustomize.NewRefresher(time.Minute, nil, kustomize.WithJitter(1))
+			assert.EqualError(GinkgoT(), err, "refresh jitter must be in [0, 1)")
+			_, err = kustomize.NewRefresher(time.Minute, nil, kustomize.WithJitter(-0.1))
+			assert.EqualError(GinkgoT(), err, "refresh jitter must be in [0, 1)")
+		})
+	})
+
+	Context("when the refresher runs", func() {
+		It("should refresh on the interval and stop when the context is done", func() {
+			counter := &countingRenderer{Renderer: krusty.MakeKustomizer(krusty.MakeDefaultOptions())}
+			refresher, err := kustomize.NewRefresher(10*time.Millisecond, nil, kustomize.WithJitter(0.5))
+			assert.NoError(GinkgoT(), err)
+			refresher.Register(wrapper(counter, "dev"))
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan struct{})
+			go func() {
+				refresher.Run(ctx)
+				close(stopped)
+			}()
+			assert.Eventually(GinkgoT(), func() bool {
+				return atomic.LoadInt32(&counter.runs) == 1
+			}, time.Second, time.Millisecond)
+			revision.Store("v2")
+			assert.Eventually(GinkgoT(), func() bool {
+				return atomic.LoadInt32(&counter.runs) == 2
+			}, time.Second, time.Millisecond)
+
+			cancel()
+			select {
+			case <-stopped:
+			case <-time.After(time.Second):
+				Fail("the refresher did not stop")
+			}
+		})
+	})
+})
+
+// concurrencyProvider records the most revision checks running at once
+type concurrencyProvider struct {
+	revision string
+	mu       sync.Mutex
+	running  int
+	checks   int
+	max      int
+}
+
+func (p *concurrencyProvider) Revision(context.Context, cache.Key, string) (string, error) {
+	p.mu.Lock()
+	p.running++
+	p.checks++
+	if p.running > p.max {
+		p.max = p.running
+	}
+	p.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+	return p.revision, nil
+}
@@ -0,0 +1,53 @@
+package kustomize
+
+import (
+	"github.com/thallesfreitaszup/lib-kustomize/cache"
+	"net/url"
+	"strings"
+)
+
+// remoteSource converts a remote base or resource of a kustomization to the go-getter source of its repository,
+// reporting false when the entry is not a remote url. Besides go-getter sources, kustomize accepts urls where
+// the repository ends at the .git suffix or at the second path segment and the rest is the subdirectory,
+// e.g. github.com/org/repo/overlays/dev?ref=v1
+func remoteSource(entry string) (string, bool) {
+	raw, rawQuery := entry, ""
+	if i := strings.Index(entry, "?"); i >= 0 {
+		raw, rawQuery = entry[:i], entry[i+1:]
+	}
+	rest := raw
+	if i := strings.Index(rest, "://"); i >= 0 {
+		rest = rest[i+3:]
+	}
+	if strings.Contains(raw, "::") || strings.Contains(rest, "//") {
+		source, err := cache.ParseSource(entry)
+		if err != nil || !strings.Contains(source.Host, ".") {
+			return "", false
+		}
+		return source.String(), true
+	}
+	source, err := cache.ParseSource(raw)
+	if err != nil || !strings.Contains(source.Host, ".") {
+		return "", false
+	}
+	segments := strings.Split(source.Path, "/")
+	end := 2
+	for i, segment := range segments {
+		if strings.HasSuffix(segment, ".git") {
+			end = i + 1
+			break
+		}
+	}
+	if end > len(segments) {
+		return "", false
+	}
+	source.Path = strings.Join(segments[:end], "/")
+	source.Subdir = strings.Join(segments[end:], "/")
+	if query, err := url.ParseQuery(rawQuery); err == nil {
+		source.Ref = query.Get("version")
+		if ref := query.Get("ref"); ref != "" {
+			source.Ref = ref
+		}
+	}
+	return source.String(), true
+}